@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"o11y-canary/internal/canary"
+	"o11y-canary/internal/config"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// checkConfig implements the check-config subcommand, printing every configuration problem and returning the exit code
+func checkConfig(args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	configFileFlag := fs.String("config", "config.yaml", "Path to the configuration file")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	cfg, err := config.Load(*configFileFlag)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *configFileFlag, err)
+		return 1
+	}
+	if err := validateConfig(cfg); err != nil {
+		problems := strings.Split(err.Error(), "\n")
+		for _, problem := range problems {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *configFileFlag, problem)
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d problem(s) found\n", *configFileFlag, len(problems))
+		return 1
+	}
+	fmt.Printf("%s: configuration is valid, %d canaries\n", *configFileFlag, len(cfg.Canaries))
+	return 0
+}
+
+// validateConfig runs the config package validation and checks every canary type has a registered monitor
+func validateConfig(cfg *config.CanariesConfig) error {
+	errs := []error{cfg.Validate()}
+	names := make([]string, 0, len(cfg.Canaries))
+	for name := range cfg.Canaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	types := canary.MonitorTypes()
+	for _, name := range names {
+		if typ := cfg.Canaries[name].Type; !slices.Contains(types, typ) {
+			errs = append(errs, fmt.Errorf("canary %q: unknown type %q, use one of %s", name, typ, strings.Join(types, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
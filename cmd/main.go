@@ -2,22 +2,25 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
-	"net/http/pprof"
 	"o11y-canary/internal/canary"
 	"o11y-canary/internal/config"
+	"o11y-canary/internal/server"
 	"o11y-canary/pkg/otelsetup"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -27,15 +30,17 @@ import (
 	"go.opentelemetry.io/otel/sdk/resource"
 	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
 	"go.opentelemetry.io/otel/trace"
-	yaml "gopkg.in/yaml.v2"
 )
 
 // Version is automatically populated from linker
 var Version = "development"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(checkConfig(os.Args[2:]))
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	defaultLogLevel := "info"
@@ -43,6 +48,7 @@ func main() {
 	logLevel := flag.String("log.level", defaultLogLevel, "Set log level (options: info, warn, error, debug)")
 	configFileFlag := flag.String("config", "config.yaml", "Path to the configuration file")
 	tracingEndpoint := flag.String("tracing.endpoint", "localhost:4317", "Tracing endpoint")
+	listenAddress := flag.String("web.listen-address", ":8080", "Address to serve metrics, health and status on")
 	flag.Parse()
 
 	var slogLevel slog.Level
@@ -64,43 +70,19 @@ func main() {
 	slog.SetDefault(slog.New(handler))
 	slog.Info("Logger initialized", "level", *logLevel)
 
-	file, err := os.Open(*configFileFlag)
+	cfg, err := config.Load(*configFileFlag)
 	if err != nil {
-		slog.Error("Error decoding YAML", "error", err)
-	}
-	defer file.Close()
-
-	var canaryConfig config.CanariesConfig
-	decoder := yaml.NewDecoder(file)
-	if err := decoder.Decode(&canaryConfig); err != nil {
-		slog.Error("Error decoding YAML", "error", err)
+		slog.Error("Failed to load configuration", "config_file", *configFileFlag, "error", err)
 		os.Exit(1)
-	} else {
-		slog.Debug("Configuration loaded successfully", "config", canaryConfig)
 	}
-
-	// apply defaults to config if they are not set
-	for name := range canaryConfig.Canaries {
-		config := canaryConfig.Canaries[name]
-
-		if config.MaxActiveSeries == 0 {
-			config.MaxActiveSeries = 50
-		}
-		if config.Interval == 0 {
-			config.Interval = 5 * time.Second
-		}
-		if config.WriteTimeout == 0 {
-			config.WriteTimeout = 10 * time.Second
-		}
-		if config.QueryTimeout == 0 {
-			config.QueryTimeout = 60 * time.Second
+	if err := validateConfig(cfg); err != nil {
+		for _, problem := range strings.Split(err.Error(), "\n") {
+			slog.Error("Invalid configuration", "config_file", *configFileFlag, "problem", problem)
 		}
-		if config.Type == "" {
-			config.Type = "metrics"
-		}
-
-		canaryConfig.Canaries[name] = config
+		os.Exit(1)
 	}
+	canaryConfig := *cfg
+	slog.Debug("Configuration loaded successfully", "config", canaryConfig)
 
 	// Set up OpenTelemetry.
 	otelShutdown, err := otelsetup.SetupOTelSDK(ctx, Version, *tracingEndpoint)
@@ -125,18 +107,27 @@ func main() {
 		"service.namespace", otelsetup.ServiceString,
 	)
 
-	otelsetup.InitializeResource(Version)
+	// the instance identifies this replica when the internal metrics are pushed instead of scraped
+	hostname, _ := os.Hostname()
+	internalResource, err := resource.Merge(otelsetup.InitializeResource(Version), resource.NewSchemaless(semconv.ServiceInstanceIDKey.String(hostname)))
+	if err != nil {
+		log.Fatalf("failed to create resource: %v", err)
+	}
 
-	r := mux.NewRouter()
+	status := server.NewStatus()
+	srv := server.New(*listenAddress, status)
 
 	// internal metric setup
 	promExporter, err := otelprom.New(otelprom.WithRegisterer(prometheus.DefaultRegisterer), otelprom.WithoutScopeInfo())
 	if err != nil {
 		log.Fatalf("failed to create Prometheus exporter: %v", err)
 	}
+	internalMetrics := canary.NewInternalMetricsPusher()
 
 	promMeterProvider := otelmetric.NewMeterProvider(
 		otelmetric.WithReader(promExporter),
+		otelmetric.WithReader(internalMetrics.Reader),
+		otelmetric.WithResource(internalResource),
 	)
 
 	// this meter is for internal metrics
@@ -158,49 +149,107 @@ func main() {
 	))
 
 	// Register internal/special metrics ONCE at the top level with the Prometheus meter
+	canary.InstrumentTLS(meter)
 	queriesTotal, _ := meter.Int64Counter(
 		"o11y_canary_queries_total",
-		metric.WithDescription("Total number of query attempts, including success and failures"),
+		metric.WithDescription("Total number of query checks per endpoint, including success and failures"),
 	)
 	querySuccesses, _ := meter.Int64Counter(
 		"o11y_canary_query_successes_total",
 		metric.WithDescription("Total number of successful queries"),
 	)
+	queryRetries, _ := meter.Int64Counter(
+		"o11y_canary_query_retries_total",
+		metric.WithDescription("Retries of queries after a transient failure, per query_retry"),
+	)
 	queryErrors, _ := meter.Int64Counter(
 		"o11y_canary_query_errors_total",
 		metric.WithDescription("Total number of failed queries"),
 	)
 	durationHistogram, _ := meter.Float64Histogram(
 		"o11y_canary_query_duration_seconds",
-		metric.WithDescription("Duration of successful queries"),
+		metric.WithDescription("Duration of the query that first found the canaried data"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(0.01, 0.1, 0.2, 0.5, 1, 2, 5, 10, 15, 30, 60, 120, 240, 480),
+	)
+	queryPollAttempts, _ := meter.Int64Counter(
+		"o11y_canary_query_poll_attempts_total",
+		metric.WithDescription("Total number of queries issued while polling for canaried data to become visible"),
+	)
+	dataMismatches, _ := meter.Int64Counter(
+		"o11y_canary_data_mismatch_total",
+		metric.WithDescription("Total number of queries that found canaried data differing from what was written"),
+	)
+	writesTotal, _ := meter.Int64Counter(
+		"o11y_canary_writes_total",
+		metric.WithDescription("Total number of write attempts, including success and failures"),
+	)
+	writesNotQueried, _ := meter.Int64Counter(
+		"o11y_canary_writes_not_queried_total",
+		metric.WithDescription("Successful writes whose data was not queried back, per query_interval and query_sample_ratio"),
+	)
+	writeRetries, _ := meter.Int64Counter(
+		"o11y_canary_write_retries_total",
+		metric.WithDescription("Retries of writes after a transient failure, per write_retry"),
+	)
+	writeErrors, _ := meter.Int64Counter(
+		"o11y_canary_write_errors_total",
+		metric.WithDescription("Total number of failed writes, including timeouts"),
+	)
+	writeTimeouts, _ := meter.Int64Counter(
+		"o11y_canary_write_timeouts_total",
+		metric.WithDescription("Total number of writes that did not finish within write_timeout"),
+	)
+	writeDurationHistogram, _ := meter.Float64Histogram(
+		"o11y_canary_write_duration_seconds",
+		metric.WithDescription("Duration of writes to ingest endpoints"),
 		metric.WithUnit("s"),
 		metric.WithExplicitBucketBoundaries(0.01, 0.1, 0.2, 0.5, 1, 2, 5, 10, 15, 30, 60, 120, 240, 480),
 	)
+	queryTimeouts, _ := meter.Int64Counter(
+		"o11y_canary_query_timeouts_total",
+		metric.WithDescription("Total number of queries that did not find the canaried data within query_timeout"),
+	)
+	pathUp, _ := meter.Float64Gauge(
+		"o11y_canary_path_up",
+		metric.WithDescription("Whether the last check found data written through ingest_endpoint at query_endpoint (1) or not (0)"),
+	)
+	pathLastSuccess, _ := meter.Float64Gauge(
+		"o11y_canary_path_last_success_timestamp_seconds",
+		metric.WithDescription("Unix time of the last check that found data written through ingest_endpoint at query_endpoint"),
+		metric.WithUnit("s"),
+	)
+	reloadSuccess, _ := meter.Float64Gauge(
+		"o11y_canary_config_last_reload_success",
+		metric.WithDescription("Whether the last configuration reload succeeded (1) or failed (0)"),
+	)
+	reloadTimestamp, _ := meter.Float64Gauge(
+		"o11y_canary_config_last_reload_success_timestamp_seconds",
+		metric.WithDescription("Unix time of the last successful configuration reload"),
+		metric.WithUnit("s"),
+	)
 	lagHistogram, _ := meter.Float64Histogram(
 		"o11y_canary_lag_duration_seconds",
-		metric.WithDescription("Duration of how long metric takes to populate from write to query"),
+		metric.WithDescription("Duration from write until the canaried data was first visible to a query"),
 		metric.WithUnit("s"),
 		metric.WithExplicitBucketBoundaries(0.01, 0.1, 0.2, 0.5, 1, 2, 5, 10, 15, 30, 60, 120, 240, 480),
 	)
-
-	// pprof boilerplate
-	r.HandleFunc("/debug/pprof/", pprof.Index)
-	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
-	r.HandleFunc("/debug/pprof/allocs", pprof.Handler("allocs").ServeHTTP)
-	r.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
-
-	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
-
-	go func() {
-		slog.Info("Starting metrics & profiling http server", "port", 8080)
-		if err := http.ListenAndServe(":8080", r); err != nil {
-			slog.Error("Failed to start server", "error", err)
-			os.Exit(1)
-		}
-	}()
+	tokenErrors, _ := meter.Int64Counter(
+		"o11y_canary_auth_token_errors_total",
+		metric.WithDescription("Total number of writes and queries that failed because an OAuth2 token or AWS role credentials could not be fetched"),
+	)
+	isolationChecks, _ := meter.Int64Counter(
+		"o11y_canary_tenant_isolation_checks_total",
+		metric.WithDescription("Total number of queries as query_tenant for data written for tenant"),
+	)
+	isolationViolations, _ := meter.Int64Counter(
+		"o11y_canary_tenant_isolation_violations_total",
+		metric.WithDescription("Total number of times data written for tenant was visible to query_tenant"),
+	)
+	isolationErrors, _ := meter.Int64Counter(
+		"o11y_canary_tenant_isolation_errors_total",
+		metric.WithDescription("Total number of tenant isolation checks that failed without telling whether the data was visible"),
+	)
 
 	// canonical trace
 	tracer := otel.Tracer("o11y-canary")
@@ -218,180 +267,449 @@ func main() {
 	)
 	defer span.End()
 
-	var wg sync.WaitGroup
+	// run is the lifetime of one canary, started and stopped by the manager as the configuration changes
+	run := func(ctx context.Context, name string, canaryConfig config.CanaryConfig) {
+		tracer := otel.Tracer("o11y-canary")
 
-	for canaryName, canaryConfig := range canaryConfig.Canaries {
-		wg.Add(1)
-		go func(name string, canaryConfig config.CanaryConfig) {
-			defer wg.Done()
-			tracer := otel.Tracer("o11y-canary")
+		// combine these for the trace output
+		ingestURLs := []string{}
+		for _, ep := range canaryConfig.Ingest {
+			ingestURLs = append(ingestURLs, ep.URL)
+		}
+		queryURLs := []string{}
+		for _, ep := range canaryConfig.Query {
+			queryURLs = append(queryURLs, ep.URL)
+		}
 
-			// combine these for the trace output
-			ingestURLs := []string{}
-			for _, ep := range canaryConfig.Ingest {
-				ingestURLs = append(ingestURLs, ep.URL)
-			}
-			queryURLs := []string{}
-			for _, ep := range canaryConfig.Query {
-				queryURLs = append(queryURLs, ep.URL)
+		canaryCtx, canarySpan := tracer.Start(ctx, fmt.Sprintf("canary-%s", name),
+			trace.WithAttributes(
+				attribute.String("canary.name", name),
+				attribute.String("canary.type", canaryConfig.Type),
+				attribute.StringSlice("ingest.endpoints", ingestURLs),
+				attribute.StringSlice("query.endpoints", queryURLs),
+				attribute.Bool("tls.global_enabled", canaryConfig.TLS != nil && canaryConfig.TLS.Enabled),
+				attribute.Int64("write_interval_ms", canaryConfig.WriteInterval.Milliseconds()),
+				attribute.Int64("query_interval_ms", canaryConfig.QueryInterval.Milliseconds()),
+				attribute.Float64("query_sample_ratio", canaryConfig.QuerySampleRatio),
+				attribute.Int64("write_timeout_ms", canaryConfig.WriteTimeout.Microseconds()),
+				attribute.Int64("query_timeout_ms", canaryConfig.QueryTimeout.Microseconds()),
+			),
+		)
+		canarySpan.AddEvent("Canary initialized")
+
+		// a canary without tenants writes and queries as the single unnamed tenant, which leaves the endpoints untouched
+		tenants := canaryConfig.Tenants
+		if len(tenants) == 0 {
+			tenants = []config.Tenant{{}}
+		}
+		tenantNames := make([]string, len(tenants))
+		for t, tenant := range tenants {
+			tenantNames[t] = tenant.Name
+		}
+		status.Start(name, canaryConfig.Type, tenantNames, ingestURLs, queryURLs)
+
+		res := resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(name),
+			semconv.ServiceNamespaceKey.String(otelsetup.ServiceString),
+			semconv.ServiceVersionKey.String(Version),
+		)
+
+		// Initialize client setup outside the ticker loop
+		// Each canary gets its own meterProvider (+ grpc client), cleanup func, and single gauge metric
+		ingestURLs = make([]string, len(canaryConfig.Ingest))
+		ingestTLSConfigs := make([]*config.TLSConfig, len(canaryConfig.Ingest))
+		for i, endpoint := range canaryConfig.Ingest {
+			ingestURLs[i] = endpoint.URL
+			if endpoint.TLS != nil {
+				ingestTLSConfigs[i] = endpoint.TLS
+			} else {
+				ingestTLSConfigs[i] = canaryConfig.TLS
 			}
-
-			canaryCtx, canarySpan := tracer.Start(ctx, fmt.Sprintf("canary-%s", name),
-				trace.WithAttributes(
-					attribute.String("canary.name", name),
-					attribute.String("canary.type", canaryConfig.Type),
-					attribute.StringSlice("ingest.endpoints", ingestURLs),
-					attribute.StringSlice("query.endpoints", queryURLs),
-					attribute.Bool("tls.global_enabled", canaryConfig.TLS != nil && canaryConfig.TLS.Enabled),
-					attribute.Int64("interval_ms", canaryConfig.Interval.Milliseconds()),
-					attribute.Int64("write_timeout_ms", canaryConfig.WriteTimeout.Microseconds()),
-					attribute.Int64("query_timeout_ms", canaryConfig.QueryTimeout.Microseconds()),
-				),
-			)
-			canarySpan.AddEvent("Canary initialized")
-
-			res := resource.NewWithAttributes(
-				semconv.SchemaURL,
-				semconv.ServiceNameKey.String(canaryName),
-				semconv.ServiceNamespaceKey.String(otelsetup.ServiceString),
-				semconv.ServiceVersionKey.String(Version),
-			)
-
-			var c canary.Canary
-
-			// Initialize client setup outside the ticker loop
-			// Each canary gets its own meterProvider (+ grpc client), cleanup func, and single gauge metric
-			ingestURLs = make([]string, len(canaryConfig.Ingest))
-			ingestTLSConfigs := make([]*config.TLSConfig, len(canaryConfig.Ingest))
-			for i, endpoint := range canaryConfig.Ingest {
-				ingestURLs[i] = endpoint.URL
-				if endpoint.TLS != nil {
-					ingestTLSConfigs[i] = endpoint.TLS
-				} else {
-					ingestTLSConfigs[i] = canaryConfig.TLS
+		}
+		// every tenant gets its own canary so the samples written for one are never verified against another's
+		canaries := make([]*canary.Canary, len(tenants))
+		// make a new client for each tenant and ingestion URL, all writing in parallel
+		writers := make([][]canary.Writer, len(tenants))
+		defer func() {
+			for _, tenantWriters := range writers {
+				for _, writer := range tenantWriters {
+					writer.Close()
 				}
 			}
-			// make a new client for each ingestion URL
-			for i, url := range ingestURLs {
-				meterProvider, cleanup, gauge, err := c.InitClient(
-					canaryCtx, res, url, canaryConfig.Interval, canaryConfig.WriteTimeout, ingestTLSConfigs[i],
+		}()
+		for t, tenant := range tenants {
+			canaries[t] = &canary.Canary{
+				Name:               name,
+				Type:               canaryConfig.Type,
+				ValueTolerance:     canaryConfig.ValueTolerance,
+				TimestampTolerance: canaryConfig.TimestampTolerance,
+				AdditionalLabels:   canaryConfig.AdditionalLabels,
+				Tenant:             tenant.Name,
+				WriteRetry:         retryPolicy(canaryConfig.WriteRetry),
+				QueryRetry:         retryPolicy(canaryConfig.QueryRetry),
+			}
+			for i := range ingestURLs {
+				writer, err := canaries[t].InitClient(
+					canaryCtx, res, tenant.Endpoint(canaryConfig.Ingest[i]), canaryConfig.WriteInterval, canaryConfig.WriteTimeout, ingestTLSConfigs[i],
 				)
 				if err != nil {
-					errMsg := "Failed to initialize metric client"
+					errMsg := "Failed to initialize ingest client"
 					canarySpan.RecordError(err)
 					canarySpan.SetStatus(codes.Error, errMsg)
 					canarySpan.AddEvent(errMsg)
 					slog.Error(errMsg, "error", err)
+					status.RecordError(name, fmt.Errorf("%s: %w", errMsg, err))
 					canarySpan.End()
 					return
 				}
-				// Launch a goroutine for each time series (cardinality)
-				seriesWg := &sync.WaitGroup{}
-				for seriesIdx := 0; seriesIdx < canaryConfig.MaxActiveSeries; seriesIdx++ {
-					seriesWg.Add(1)
-					go func(seriesIdx int) {
-						defer seriesWg.Done()
-						ticker := time.NewTicker(canaryConfig.Interval)
-						defer ticker.Stop()
-						for {
-							select {
-							case <-canaryCtx.Done():
-								infoMsg := "Canary shutdown after context cancellation"
-								canarySpan.SetStatus(codes.Ok, infoMsg)
-								canarySpan.AddEvent(infoMsg)
-								slog.Info(infoMsg, "name", name)
-								canarySpan.End()
+				writers[t] = append(writers[t], writer)
+			}
+		}
+
+		queryTLSConfigs := make([]*config.TLSConfig, len(canaryConfig.Query))
+		for i, endpoint := range canaryConfig.Query {
+			if endpoint.TLS != nil {
+				queryTLSConfigs[i] = endpoint.TLS
+			} else {
+				queryTLSConfigs[i] = canaryConfig.TLS
+			}
+		}
+		pollConfig := canary.PollConfig{
+			InitialDelay: canaryConfig.QueryInitialDelay,
+			Interval:     canaryConfig.QueryPollInterval,
+			Backoff:      canaryConfig.QueryPollBackoff,
+			MaxInterval:  canaryConfig.QueryPollMaxInterval,
+			Deadline:     canaryConfig.QueryTimeout,
+		}
+		// signal label lets lag be compared across canary types
+		signalAttr := attribute.String("signal", canaryConfig.Type)
+		// additional labels route canary alerts, so the internal metrics carry them too
+		labelAttrs := canary.AdditionalAttributes(canaryConfig.AdditionalLabels)
+		if len(labelAttrs) != len(canaryConfig.AdditionalLabels) {
+			slog.Warn("Ignoring additional labels with names reserved by the canary", "canary", name, "additional_labels", canaryConfig.AdditionalLabels)
+		}
+
+		// checkIsolation queries as every other tenant for the data of tenant t found at query endpoint q
+		// seeing it there is a violation, not seeing it only counts because the data was just found as tenant t
+		checkIsolation := func(ctx context.Context, span trace.Span, t int, q int, ingestURL string, requestID string, written canary.WriteResult, attrs []attribute.KeyValue) error {
+			var errs []error
+			for _, other := range tenants {
+				if other.Name == tenants[t].Name {
+					continue
+				}
+				isolationAttrs := append(slices.Clone(attrs), attribute.String("query_tenant", other.Name))
+				err := canaries[t].CheckIsolation(ctx, canaryConfig.Query[q], other, ingestURL, requestID, written, canaryConfig.QueryTimeout, queryTLSConfigs[q])
+				isolationChecks.Add(context.Background(), 1, metric.WithAttributes(isolationAttrs...))
+				var violation *canary.IsolationError
+				switch {
+				case errors.As(err, &violation):
+					isolationViolations.Add(context.Background(), 1, metric.WithAttributes(isolationAttrs...))
+					span.RecordError(err)
+					span.SetStatus(codes.Error, "Tenant isolation violated")
+					slog.Error("Tenant isolation violated", "canary", name, "tenant", tenants[t].Name, "query_tenant", other.Name, "url", canaryConfig.Query[q].URL, "canary_request_id", requestID)
+					errs = append(errs, err)
+				case err != nil:
+					isolationErrors.Add(context.Background(), 1, metric.WithAttributes(isolationAttrs...), metric.WithAttributes(attribute.String("reason", canary.Classify("query", err))))
+					slog.Warn("Tenant isolation check failed", "canary", name, "tenant", tenants[t].Name, "query_tenant", other.Name, "url", canaryConfig.Query[q].URL, "error", err)
+					errs = append(errs, err)
+				}
+			}
+			return errors.Join(errs...)
+		}
+
+		// check writes one series as every tenant through every ingest endpoint and, when the series is due for a query,
+		// returns the polling of all query endpoints for each successful write, which the scheduler runs apart so a slow
+		// query endpoint never holds up the writes
+		check := func(ctx context.Context, series canary.Series) canary.QueryFunc {
+			runCtx, runSpan := tracer.Start(ctx, fmt.Sprintf("canary-write-%s-%d", name, series.Index),
+				trace.WithAttributes(attribute.String("canary_request_id", series.RequestID)),
+			)
+			defer runSpan.End()
+			runSpan.AddEvent("Running canary check")
+			requestID := series.RequestID
+
+			// every failed write or query of the check ends up in the canary's status, kept apart so a later check that
+			// only writes leaves the query errors in place
+			var checkMu sync.Mutex
+			var writeErrs, queryErrs []error
+			recordErr := func(errs *[]error, err error) {
+				checkMu.Lock()
+				*errs = append(*errs, err)
+				checkMu.Unlock()
+			}
+			// writes are the successful writes of the check, the query polls for the data each of them sent rather than
+			// the series' latest, which later checks overwrite while it polls
+			type write struct {
+				tenant    int
+				ingestURL string
+				attrs     []attribute.KeyValue
+				written   canary.WriteResult
+			}
+			var writes []write
+
+			var ingestWg sync.WaitGroup
+			for t, tenant := range tenants {
+				c := canaries[t]
+				// only multi-tenant canaries carry the tenant label
+				var tenantAttrs []attribute.KeyValue
+				if tenant.Name != "" {
+					tenantAttrs = append(tenantAttrs, attribute.String("tenant", tenant.Name))
+				}
+				for i, writer := range writers[t] {
+					ingestWg.Add(1)
+					go func(ingestURL string, writer canary.Writer) {
+						defer ingestWg.Done()
+						// protocol label lets lag be compared across ingest transports
+						protocolAttr := attribute.String("protocol", writer.Protocol())
+						// endpoint labels pinpoint the broken hop when a canary has several ingest or query endpoints
+						writeAttrs := append([]attribute.KeyValue{
+							attribute.String("canary_name", name), protocolAttr, signalAttr, attribute.String("ingest_endpoint", ingestURL),
+						}, tenantAttrs...)
+						writeAttrs = append(writeAttrs, labelAttrs...)
+						insertionTime := time.Now()
+						var writeWg sync.WaitGroup
+						writeWg.Add(1)
+						written, retries, err := c.Write(runCtx, writer, ingestURL, requestID, canaryConfig.WriteTimeout, &writeWg)
+						writeWg.Wait()
+						writesTotal.Add(context.Background(), 1, metric.WithAttributes(writeAttrs...))
+						// retries tell a flaky endpoint apart from a down one, they are not failures as long as a write succeeds
+						writeRetries.Add(context.Background(), int64(retries), metric.WithAttributes(writeAttrs...))
+						writeDurationHistogram.Record(context.Background(), time.Since(insertionTime).Seconds(), metric.WithAttributes(writeAttrs...))
+						status.RecordWrite(name, tenant.Name, ingestURL, err)
+						if err != nil {
+							// the reason lets runbooks branch on the cause without parsing the error
+							reason := attribute.String("reason", canary.Classify("write", err))
+							writeErrors.Add(context.Background(), 1, metric.WithAttributes(writeAttrs...), metric.WithAttributes(reason))
+							var timeout *canary.TimeoutError
+							if errors.As(err, &timeout) {
+								writeTimeouts.Add(context.Background(), 1, metric.WithAttributes(writeAttrs...))
+							}
+							var tokenErr *canary.TokenError
+							if errors.As(err, &tokenErr) {
+								tokenErrors.Add(context.Background(), 1, metric.WithAttributes(writeAttrs...), metric.WithAttributes(attribute.String("operation", "write")))
+							}
+							runSpan.RecordError(err, trace.WithAttributes(reason))
+							runSpan.SetAttributes(reason)
+							runSpan.SetStatus(codes.Error, "Failed to write metrics")
+							slog.Error("Failed to write metrics", "canary", name, "tenant", tenant.Name, "series", series.Index, "url", ingestURL, "reason", reason.Value.AsString(), "error", err)
+							recordErr(&writeErrs, fmt.Errorf("write to %s: %w", ingestURL, err))
+							// nothing to look for, querying would only blame the query endpoints for the write
+							return
+						}
+						runSpan.AddEvent("Metrics written successfully")
+						if !series.Query {
+							// writes are measured on every check, queries only follow the writes the scheduler picked
+							writesNotQueried.Add(context.Background(), 1, metric.WithAttributes(writeAttrs...))
+							return
+						}
+						checkMu.Lock()
+						writes = append(writes, write{tenant: t, ingestURL: ingestURL, attrs: writeAttrs, written: written})
+						checkMu.Unlock()
+					}(ingestURLs[i], writer)
+				}
+			}
+			ingestWg.Wait()
+			status.RecordWriteCheck(name, errors.Join(writeErrs...))
+			if !series.Query {
+				return nil
+			}
+
+			return func(ctx context.Context) {
+				queryCtx, querySpan := tracer.Start(trace.ContextWithSpan(ctx, runSpan), fmt.Sprintf("canary-query-%s-%d", name, series.Index),
+					trace.WithAttributes(attribute.String("canary_request_id", series.RequestID)),
+				)
+				defer querySpan.End()
+
+				// Poll all endpoints concurrently so each one's lag is its own first moment of visibility
+				// every (ingest, query) pair is a path of its own, measured and labelled independently
+				var queryWg sync.WaitGroup
+				for _, w := range writes {
+					t, c, tenant, ingestURL, written := w.tenant, canaries[w.tenant], tenants[w.tenant], w.ingestURL, w.written
+					for i, endpoint := range canaryConfig.Query {
+						queryWg.Add(1)
+						go func(i int, url string) {
+							defer queryWg.Done()
+							metricAttrs := append(slices.Clone(w.attrs), attribute.String("query_endpoint", url))
+							result, queryErr := c.PollQuery(queryCtx, tenant.Endpoint(canaryConfig.Query[i]), ingestURL, requestID, written, pollConfig, queryTLSConfigs[i])
+							if queryErr != nil && queryCtx.Err() != nil {
+								// the canary was stopped while polling, e.g. by a reload, which says nothing about the path
 								return
-							case <-ticker.C:
-								runCtx, runSpan := tracer.Start(canaryCtx, fmt.Sprintf("canary-write-%s-%d", name, seriesIdx))
-								runSpan.AddEvent("Running canary check")
-								var requestID string
-								if len(c.ActiveRequestIDs) < canaryConfig.MaxActiveSeries {
-									requestID = runSpan.SpanContext().SpanID().String()
-									c.ActiveRequestIDs = append(c.ActiveRequestIDs, requestID)
-								} else {
-									requestID = c.ActiveRequestIDs[seriesIdx%canaryConfig.MaxActiveSeries]
-								}
-								insertionTime := time.Now()
-								c.InsertionTimestamps.Store(requestID, insertionTime)
-								var writeWg sync.WaitGroup
-								writeWg.Add(1)
-								err := c.Write(runCtx, meterProvider, ingestURLs, gauge, requestID, canaryConfig.WriteTimeout, &writeWg)
-								writeWg.Wait()
-								if err != nil {
-									runSpan.RecordError(err)
-									runSpan.SetStatus(codes.Error, "Failed to write metrics")
-									slog.Error("Failed to write metrics", "error", err)
-								} else {
-									runSpan.AddEvent("Metrics written successfully")
+							}
+							queriesTotal.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...))
+							queryPollAttempts.Add(context.Background(), int64(result.Attempts), metric.WithAttributes(metricAttrs...))
+							queryRetries.Add(context.Background(), int64(result.Retries), metric.WithAttributes(metricAttrs...))
+							if queryErr != nil {
+								reason := attribute.String("reason", canary.Classify("query", queryErr))
+								querySpan.RecordError(queryErr, trace.WithAttributes(reason))
+								querySpan.SetAttributes(reason)
+								queryErrors.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...), metric.WithAttributes(reason))
+								var timeout *canary.TimeoutError
+								if errors.As(queryErr, &timeout) {
+									queryTimeouts.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...))
 								}
-								slog.Debug("Waiting for write_timeout before querying", "write_timeout", canaryConfig.WriteTimeout)
-								time.Sleep(canaryConfig.WriteTimeout)
-								// Instead of re-registering, use the top-level instruments:
-								queriesTotal.Add(context.Background(), 1, metric.WithAttributes(
-									attribute.String("canary_name", name),
-								))
-								queryURLs := make([]string, len(canaryConfig.Query))
-								queryTLSConfigs := make([]*config.TLSConfig, len(canaryConfig.Query))
-								for i, endpoint := range canaryConfig.Query {
-									queryURLs[i] = endpoint.URL
-									if endpoint.TLS != nil {
-										queryTLSConfigs[i] = endpoint.TLS
-									} else {
-										queryTLSConfigs[i] = canaryConfig.TLS
-									}
+								var tokenErr *canary.TokenError
+								if errors.As(queryErr, &tokenErr) {
+									tokenErrors.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...), metric.WithAttributes(attribute.String("operation", "query")))
 								}
-								// Query all endpoints, record metrics per endpoint
-								for i, url := range queryURLs {
-									var queryWg sync.WaitGroup
-									queryWg.Add(1)
-									endpointStart := time.Now()
-									queryErr := c.Query(runCtx, []string{url}, requestID, canaryConfig.QueryTimeout, queryTLSConfigs[i], &queryWg)
-									queryWg.Wait()
-									queriesTotal.Add(context.Background(), 1, metric.WithAttributes(
-										attribute.String("canary_name", name),
+								var mismatch *canary.MismatchError
+								if errors.As(queryErr, &mismatch) {
+									dataMismatches.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...), metric.WithAttributes(
+										attribute.String("reason", mismatch.Reason),
 									))
-									if queryErr != nil {
-										runSpan.RecordError(queryErr)
-										queryErrors.Add(context.Background(), 1, metric.WithAttributes(
-											attribute.String("canary_name", name),
-										))
-										slog.Error("Query failed", "canary", name, "series", seriesIdx, "url", url, "error", queryErr)
-									} else {
-										querySuccesses.Add(context.Background(), 1, metric.WithAttributes(
-											attribute.String("canary_name", name),
-										))
-										duration := time.Since(endpointStart).Seconds()
-										durationHistogram.Record(context.Background(), duration, metric.WithAttributes(
-											attribute.String("canary_name", name),
-										))
-										if val, ok := c.InsertionTimestamps.Load(requestID); ok {
-											if insertedAt, ok := val.(time.Time); ok {
-												lag := time.Since(insertedAt).Seconds()
-												lagHistogram.Record(context.Background(), lag, metric.WithAttributes(
-													attribute.String("canary_name", name),
-												))
-											} else {
-												slog.Warn("Insertion timestamp is not a valid time.Time", "request_id", requestID, "value", val)
-											}
-											c.InsertionTimestamps.Delete(requestID)
-										} else {
-											slog.Warn("Insertion timestamp not found for request ID", "request_id", requestID)
-										}
-										slog.Info("Query succeeded", "canary", name, "series", seriesIdx, "url", url)
-										runSpan.AddEvent("Metrics queried successfully")
-									}
 								}
-								runSpan.End()
-
+								pathUp.Record(context.Background(), 0, metric.WithAttributes(metricAttrs...))
+								status.RecordQuery(name, tenant.Name, ingestURL, url, 0, queryErr)
+								recordErr(&queryErrs, fmt.Errorf("query %s for data written to %s: %w", url, ingestURL, queryErr))
+								slog.Error("Query failed", "canary", name, "tenant", tenant.Name, "series", series.Index, "ingest", ingestURL, "url", url, "attempts", result.Attempts, "reason", reason.Value.AsString(), "error", queryErr)
+								return
 							}
-						}
-					}(seriesIdx)
+							querySuccesses.Add(context.Background(), 1, metric.WithAttributes(metricAttrs...))
+							durationHistogram.Record(context.Background(), result.Duration.Seconds(), metric.WithAttributes(metricAttrs...))
+							// lag counts from the write of the data that became visible, retries of the write excluded
+							lag := result.VisibleAt.Sub(written.Timestamp).Seconds()
+							lagHistogram.Record(context.Background(), lag, metric.WithAttributes(metricAttrs...))
+							status.RecordQuery(name, tenant.Name, ingestURL, url, result.VisibleAt.Sub(written.Timestamp), nil)
+							pathUp.Record(context.Background(), 1, metric.WithAttributes(metricAttrs...))
+							pathLastSuccess.Record(context.Background(), float64(time.Now().Unix()), metric.WithAttributes(metricAttrs...))
+							slog.Info("Query succeeded", "canary", name, "tenant", tenant.Name, "series", series.Index, "ingest", ingestURL, "url", url, "attempts", result.Attempts, "lag", lag)
+							querySpan.AddEvent("Metrics queried successfully")
+							if canaryConfig.TenantIsolationCheck {
+								if err := checkIsolation(queryCtx, querySpan, t, i, ingestURL, requestID, written, metricAttrs); err != nil {
+									recordErr(&queryErrs, err)
+								}
+							}
+						}(i, endpoint.URL)
+					}
 				}
-				seriesWg.Wait()
-				cleanup()
+				queryWg.Wait()
+				// the paths of a failed write are checked too, the write error explains them
+				status.RecordQueryCheck(name, errors.Join(queryErrs...))
+			}
+		}
+
+		// the scheduler spreads the series checks across the write interval instead of one goroutine per series
+		scheduler, err := canary.NewScheduler(canary.SchedulerConfig{
+			Interval:         canaryConfig.WriteInterval,
+			QueryInterval:    canaryConfig.QueryInterval,
+			QuerySampleRatio: canaryConfig.QuerySampleRatio,
+			MaxActiveSeries:  canaryConfig.MaxActiveSeries,
+			Jitter:           *canaryConfig.ScheduleJitter,
+			MaxConcurrency:   canaryConfig.MaxConcurrentChecks,
+		}, check)
+		if err != nil {
+			errMsg := "Failed to initialize canary scheduler"
+			canarySpan.RecordError(err)
+			canarySpan.SetStatus(codes.Error, errMsg)
+			canarySpan.AddEvent(errMsg)
+			slog.Error(errMsg, "error", err)
+			status.RecordError(name, fmt.Errorf("%s: %w", errMsg, err))
+			canarySpan.End()
+			return
+		}
+		scheduler.Run(canaryCtx)
+
+		infoMsg := "Canary shutdown after context cancellation"
+		canarySpan.SetStatus(codes.Ok, infoMsg)
+		canarySpan.AddEvent(infoMsg)
+		slog.Info(infoMsg, "name", name)
+		canarySpan.End()
+	}
+
+	manager := canary.NewManager(ctx, run)
+	status.SetCanaries(canaryNames(canaryConfig.Canaries))
+	if err := internalMetrics.Apply(ctx, canaryConfig.InternalMetrics); err != nil {
+		slog.Error("Not pushing internal metrics", "error", err)
+	}
+	manager.Apply(canaryConfig.Canaries, internalMetrics.Endpoints()...)
+	reloadSuccess.Record(ctx, 1)
+	reloadTimestamp.Record(ctx, float64(time.Now().Unix()))
+
+	// reload re-reads the config file and only starts, stops or restarts the canaries that differ
+	var reloadMu sync.Mutex
+	reload := func() error {
+		reloadMu.Lock()
+		defer reloadMu.Unlock()
+		cfg, err := config.Load(*configFileFlag)
+		if err == nil {
+			err = validateConfig(cfg)
+		}
+		if err != nil {
+			reloadSuccess.Record(ctx, 0)
+			slog.Error("Failed to reload configuration, keeping the running canaries", "config_file", *configFileFlag, "error", err)
+			return err
+		}
+		status.SetCanaries(canaryNames(cfg.Canaries))
+		if err := internalMetrics.Apply(ctx, cfg.InternalMetrics); err != nil {
+			slog.Error("Failed to apply internal metrics endpoint, keeping the previous one", "error", err)
+		}
+		// the internal metrics endpoint in use, which is the previous one when the new one failed, keeps its state
+		result := manager.Apply(cfg.Canaries, internalMetrics.Endpoints()...)
+		reloadSuccess.Record(ctx, 1)
+		reloadTimestamp.Record(ctx, float64(time.Now().Unix()))
+		span.AddEvent("Configuration reloaded", trace.WithAttributes(
+			attribute.StringSlice("canaries.added", result.Added),
+			attribute.StringSlice("canaries.removed", result.Removed),
+			attribute.StringSlice("canaries.changed", result.Changed),
+		))
+		return nil
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("Received SIGHUP, reloading configuration", "config_file", *configFileFlag)
+				reload()
 			}
-		}(canaryName, canaryConfig)
+		}
+	}()
+
+	srv.Router.HandleFunc("/-/reload", func(w http.ResponseWriter, req *http.Request) {
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload configuration: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}).Methods("POST")
+
+	go func() {
+		if err := srv.ListenAndServe(ctx); err != nil {
+			slog.Error("Failed to start server", "address", *listenAddress, "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Shutting down, waiting for canaries to stop")
+	manager.Wait()
+	internalMetrics.Stop()
+}
+
+// canaryNames returns the names of the configured canaries
+func canaryNames(canaries map[string]config.CanaryConfig) []string {
+	names := make([]string, 0, len(canaries))
+	for name := range canaries {
+		names = append(names, name)
+	}
+	return names
+}
+
+// retryPolicy converts the configured retry policy, a canary without one never retries
+func retryPolicy(p *config.RetryPolicy) canary.RetryPolicy {
+	if p == nil {
+		return canary.RetryPolicy{}
+	}
+	return canary.RetryPolicy{
+		MaxAttempts:          p.MaxAttempts,
+		InitialBackoff:       p.InitialBackoff,
+		MaxBackoff:           p.MaxBackoff,
+		Multiplier:           p.BackoffMultiplier,
+		Jitter:               *p.Jitter,
+		RetryableStatusCodes: p.RetryableStatusCodes,
 	}
-	wg.Wait()
 }
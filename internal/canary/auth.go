@@ -0,0 +1,193 @@
+package canary
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// TokenError is returned when an OAuth2 token or assumed AWS role credentials cannot be fetched, telling credential
+// problems apart from the endpoint failing
+type TokenError struct {
+	TokenURL string
+	Err      error
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("failed to fetch token from %s: %v", e.TokenURL, e.Err)
+}
+
+func (e *TokenError) Unwrap() error {
+	return e.Err
+}
+
+// tokenFetchTimeout bounds a single token request, token sources have no context of their own
+const tokenFetchTimeout = 10 * time.Second
+
+// tokenSources caches one token source per OAuth2 configuration, so every client of the same endpoint shares its token
+// and clients built per query do not fetch a new token each time
+var tokenSources sync.Map
+
+// oauth2TokenSource returns the cached token source for cfg, tokens are reused until shortly before they expire
+func oauth2TokenSource(cfg *config.OAuth2) oauth2.TokenSource {
+	key := oauth2Key(cfg)
+	if ts, ok := tokenSources.Load(key); ok {
+		return ts.(oauth2.TokenSource)
+	}
+	ts, _ := tokenSources.LoadOrStore(key, oauth2.ReuseTokenSource(nil, &clientCredentialsSource{cfg: *cfg}))
+	return ts.(oauth2.TokenSource)
+}
+
+// oauth2Key identifies an OAuth2 configuration, scopes and params are sorted so equal configurations share a token
+func oauth2Key(cfg *config.OAuth2) string {
+	scopes := append([]string{}, cfg.Scopes...)
+	sort.Strings(scopes)
+	params := url.Values{}
+	for k, v := range cfg.EndpointParams {
+		params.Set(k, v)
+	}
+	return strings.Join([]string{cfg.TokenURL, cfg.ClientID, cfg.ClientSecret, cfg.ClientSecretFile, strings.Join(scopes, " "), params.Encode()}, "\x00")
+}
+
+// clientCredentialsSource fetches a new token on every call, reading the client secret file each time so rotated secrets work
+type clientCredentialsSource struct {
+	cfg config.OAuth2
+}
+
+func (s *clientCredentialsSource) Token() (*oauth2.Token, error) {
+	secret := s.cfg.ClientSecret
+	if s.cfg.ClientSecretFile != "" {
+		b, err := os.ReadFile(s.cfg.ClientSecretFile)
+		if err != nil {
+			return nil, &TokenError{TokenURL: s.cfg.TokenURL, Err: fmt.Errorf("failed to read client secret file: %w", err)}
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	params := url.Values{}
+	for k, v := range s.cfg.EndpointParams {
+		params.Set(k, v)
+	}
+	cc := clientcredentials.Config{
+		ClientID:       s.cfg.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       s.cfg.TokenURL,
+		Scopes:         s.cfg.Scopes,
+		EndpointParams: params,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), tokenFetchTimeout)
+	defer cancel()
+	token, err := cc.Token(ctx)
+	if err != nil {
+		return nil, &TokenError{TokenURL: s.cfg.TokenURL, Err: err}
+	}
+	return token, nil
+}
+
+// authHeaders returns the headers carrying the endpoint credentials, secret files are read on every call so rotated
+// credentials are picked up without a restart
+// A failed OAuth2 token fetch is returned as a *TokenError
+func authHeaders(auth config.Auth) (http.Header, error) {
+	header := http.Header{}
+	for name, value := range auth.Headers {
+		header.Set(name, value)
+	}
+
+	if auth.BasicAuth != nil {
+		password := auth.BasicAuth.Password
+		if auth.BasicAuth.PasswordFile != "" {
+			b, err := os.ReadFile(auth.BasicAuth.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read basic auth password file: %w", err)
+			}
+			password = strings.TrimSpace(string(b))
+		}
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.BasicAuth.Username + ":" + password))
+		header.Set("Authorization", "Basic "+credentials)
+	}
+
+	token := auth.BearerToken
+	if auth.BearerTokenFile != "" {
+		b, err := os.ReadFile(auth.BearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token file: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	if auth.OAuth2 != nil {
+		t, err := oauth2TokenSource(auth.OAuth2).Token()
+		if err != nil {
+			return nil, err
+		}
+		header.Set("Authorization", t.Type()+" "+t.AccessToken)
+	}
+	return header, nil
+}
+
+// hasAuth reports whether auth adds headers to requests, SigV4 signing is only done by newAuthRoundTripper
+func hasAuth(auth config.Auth) bool {
+	return auth.BasicAuth != nil || auth.BearerToken != "" || auth.BearerTokenFile != "" || auth.OAuth2 != nil || len(auth.Headers) > 0
+}
+
+// authRoundTripper adds the endpoint credentials and headers to every request
+type authRoundTripper struct {
+	auth config.Auth
+	next http.RoundTripper
+}
+
+// newAuthRoundTripper wraps next with the endpoint auth, it returns next unchanged when there is nothing to add
+// With SigV4 the request is signed after the headers are added
+func newAuthRoundTripper(auth config.Auth, next http.RoundTripper) http.RoundTripper {
+	if auth.SigV4 != nil {
+		next = newSigV4RoundTripper(*auth.SigV4, next)
+	}
+	if !hasAuth(auth) {
+		return next
+	}
+	return &authRoundTripper{auth: auth, next: next}
+}
+
+func (rt *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	header, err := authHeaders(rt.auth)
+	if err != nil {
+		return nil, err
+	}
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	return rt.next.RoundTrip(req)
+}
+
+// grpcAuthInterceptor sends the endpoint credentials and headers as gRPC metadata on every call
+// Unlike per-RPC credentials an interceptor returns its own errors unchanged, so a *TokenError reaches the caller
+func grpcAuthInterceptor(auth config.Auth) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		header, err := authHeaders(auth)
+		if err != nil {
+			return err
+		}
+		for name := range header {
+			ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), header.Get(name))
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
@@ -0,0 +1,155 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestHTTPClientAuth(t *testing.T) {
+	var gotUser, gotPassword, gotAuthorization, gotOrgID string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, gotPassword, _ = r.BasicAuth()
+		gotAuthorization = r.Header.Get("Authorization")
+		gotOrgID = r.Header.Get("X-Scope-OrgID")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(passwordFile, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("token-1"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(auth config.Auth) {
+		t.Helper()
+		if _, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, auth); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+
+	basic := config.Auth{
+		BasicAuth: &config.BasicAuth{Username: "canary", PasswordFile: passwordFile},
+		Headers:   map[string]string{"X-Scope-OrgID": "tenant-1"},
+	}
+	get(basic)
+	if gotUser != "canary" || gotPassword != "first" || gotOrgID != "tenant-1" {
+		t.Errorf("Expected basic auth canary:first with org ID header, got %s:%s %q", gotUser, gotPassword, gotOrgID)
+	}
+
+	// rotated secrets are picked up without building a new client
+	if err := os.WriteFile(passwordFile, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	get(basic)
+	if gotPassword != "second" {
+		t.Errorf("Expected rotated password, got %q", gotPassword)
+	}
+
+	get(config.Auth{BearerTokenFile: tokenFile})
+	if gotAuthorization != "Bearer token-1" {
+		t.Errorf("Expected bearer token from file, got %q", gotAuthorization)
+	}
+
+	get(config.Auth{})
+	if gotAuthorization != "" || gotOrgID != "" {
+		t.Errorf("Expected no auth headers, got %q %q", gotAuthorization, gotOrgID)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	var got metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		got, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	interceptor := grpcAuthInterceptor(config.Auth{BearerToken: "secret", Headers: map[string]string{"X-Scope-OrgID": "tenant-1"}})
+	if err := interceptor(context.Background(), "/export", nil, nil, nil, invoker); err != nil {
+		t.Fatalf("Interceptor failed: %v", err)
+	}
+	if got.Get("authorization")[0] != "Bearer secret" || got.Get("x-scope-orgid")[0] != "tenant-1" {
+		t.Errorf("Expected authorization and org ID metadata, got %v", got)
+	}
+
+	missing := grpcAuthInterceptor(config.Auth{BearerTokenFile: filepath.Join(t.TempDir(), "missing")})
+	if err := missing(context.Background(), "/export", nil, nil, nil, invoker); err == nil {
+		t.Errorf("Expected error for missing token file")
+	}
+}
+
+func TestOAuth2(t *testing.T) {
+	var fetches atomic.Int32
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		if id != "canary" || secret != "s3cret" || r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("audience") != "mimir" {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"token-%d","token_type":"Bearer","expires_in":3600}`, fetches.Load())
+	}))
+	defer tokenSrv.Close()
+
+	var gotAuthorization string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuthorization = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth := config.Auth{OAuth2: &config.OAuth2{
+		ClientID:         "canary",
+		ClientSecretFile: secretFile,
+		TokenURL:         tokenSrv.URL,
+		EndpointParams:   map[string]string{"audience": "mimir"},
+	}}
+
+	for i := 0; i < 3; i++ {
+		if _, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, auth); err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+	}
+	if gotAuthorization != "Bearer token-1" {
+		t.Errorf("Expected the fetched token to be sent, got %q", gotAuthorization)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("Expected the token to be fetched once and cached, got %d fetches", n)
+	}
+
+	wrongSecret := config.Auth{OAuth2: &config.OAuth2{ClientID: "canary", ClientSecret: "wrong", TokenURL: tokenSrv.URL}}
+	_, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, wrongSecret)
+	var tokenErr *TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.TokenURL != tokenSrv.URL {
+		t.Errorf("Expected a TokenError for the rejected client, got %v", err)
+	}
+
+	interceptor := grpcAuthInterceptor(wrongSecret)
+	err = interceptor(context.Background(), "/export", nil, nil, nil, func(context.Context, string, any, any, *grpc.ClientConn, ...grpc.CallOption) error {
+		t.Errorf("Expected the call not to be made without a token")
+		return nil
+	})
+	if !errors.As(err, &tokenErr) {
+		t.Errorf("Expected a TokenError from the gRPC interceptor, got %v", err)
+	}
+}
@@ -2,45 +2,49 @@ package canary
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"log/slog"
-	"net/http"
 	"o11y-canary/internal/config"
-	"o11y-canary/pkg/otelsetup"
-	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/prometheus/client_golang/api"
-	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
-	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"golang.org/x/exp/rand"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/credentials/insecure"
 )
 
-// Monitor is an interface that defines methods for canary operations
-type Monitor interface {
-	Write()
-	Query()
-	Publish()
-}
+// canariedMetricName is the synthetic series written to ingest endpoints and queried back
+const canariedMetricName = "o11y_canary_canaried_metric_total"
 
 // Canary represents a single canary with a monitor and targets
 type Canary struct {
 	// should we add more values here? ie. targets
 	//	m Monitor
 	//	t Targets
-	// InsertionTimestamps helps keep requestIDs and when they were inserted in order
-	InsertionTimestamps sync.Map
-	// ActiveRequestIDs is a list of request IDs that are currently active. Used to limit cardinality
-	ActiveRequestIDs []string
+	// Name of the canary, exported as service.name and used to find canaried logs again
+	Name string
+	// Type is the canaried signal, metrics, logs or traces
+	Type string
+	// ValueTolerance is the allowed absolute difference between the written and queried value
+	ValueTolerance float64
+	// TimestampTolerance is the allowed difference between the written and queried sample timestamp
+	TimestampTolerance time.Duration
+	// AdditionalLabels are attached to the canaried data and used to select it again
+	AdditionalLabels map[string]string
+	// Tenant is set as the tenant label on the canaried data of multi-tenant canaries, so data of one tenant is never
+	// mistaken for another's when checking isolation
+	Tenant string
+	// WriteRetry and QueryRetry retry transient failures of a single write or query, the zero value never retries
+	WriteRetry RetryPolicy
+	QueryRetry RetryPolicy
+	// traceIDs hands the trace ID a traces Writer exported a sample under to the Write of the sample, by writeKey
+	traceIDs sync.Map
+	// mon is the Monitor registered for Type, resolved on first use
+	monitorOnce sync.Once
+	mon         Monitor
+	monitorErr  error
 }
 
 // Targets holds the canary configurations
@@ -49,234 +53,164 @@ type Targets struct {
 	Config config.CanariesConfig
 }
 
-// InitClient method for Canary to provide grpc client, meterprovider (with shutdown func), and metrics for later writing
-func (c *Canary) InitClient(ctx context.Context, res *resource.Resource, target string, interval time.Duration, timeout time.Duration, tlsConfig *config.TLSConfig) (metric.MeterProvider, func(), metric.Float64Gauge, error) {
-
-	// spent a while looking at TLS Implementations, easiest to just reload on each new connection
-	var creds credentials.TransportCredentials
-	if tlsConfig != nil && tlsConfig.Enabled {
-		tlsConf := &tls.Config{
-			ServerName:         tlsConfig.ServerName,
-			InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
-			MinVersion:         tls.VersionTLS12,
-		}
-
-		if tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
-			tlsConf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-				cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
-				if err != nil {
-					return nil, fmt.Errorf("failed to load client certificates: %w", err)
-				}
-				return &cert, nil
-			}
-		}
-
-		if tlsConfig.CAFile != "" {
-			caCert, err := os.ReadFile(tlsConfig.CAFile)
-			if err != nil {
-				return nil, nil, nil, fmt.Errorf("failed to read CA file: %w", err)
-			}
-			caCertPool := x509.NewCertPool()
-			if !caCertPool.AppendCertsFromPEM(caCert) {
-				return nil, nil, nil, fmt.Errorf("failed to parse CA certificate")
-			}
-			tlsConf.RootCAs = caCertPool
-		}
-
-		creds = credentials.NewTLS(tlsConf)
-	} else {
-		creds = insecure.NewCredentials()
-	}
+// Writer pushes canaried samples to a single ingest endpoint
+type Writer interface {
+	// WriteSample records value at ts for the series identified by labels and sends it to the endpoint
+	WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error
+	// Protocol is the ingest protocol used by the writer
+	Protocol() string
+	// Close releases the connection held by the writer
+	Close()
+}
 
-	// stats handler provides automatic grpc (rpc_) metrics
-	slog.Debug("Setting up gRPC client", "target", target, "tls_enabled", tlsConfig != nil && tlsConfig.Enabled)
-	if tlsConfig != nil && tlsConfig.Enabled {
-		slog.Debug("gRPC TLS config", "server_name", tlsConfig.ServerName, "insecure_skip_verify", tlsConfig.InsecureSkipVerify, "cert_file", tlsConfig.CertFile, "key_file", tlsConfig.KeyFile, "ca_file", tlsConfig.CAFile)
-	}
-	conn, err := grpc.NewClient(target,
-		grpc.WithTransportCredentials(creds),
-		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
-	)
+// InitClient method for Canary to provide a Writer for the ingest endpoint from the Monitor registered for the canary type
+func (c *Canary) InitClient(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, interval time.Duration, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	m, err := c.monitor()
 	if err != nil {
-		slog.Error("Failed to create gRPC connection", "target", target, "error", err)
-		return nil, nil, nil, fmt.Errorf("failed to create gRPC connection: %v", err)
+		return nil, err
 	}
-	slog.Debug("gRPC client connection established", "target", target)
+	return m.NewWriter(ctx, res, endpoint, timeout, tlsConfig)
+}
 
-	// TODO - dynamic CLI flags for connection, target, etc
-	meterProvider, err := otelsetup.InitOTLPMeterProvider(ctx, res, conn, timeout)
+// Write performs a write operation through the canary's Monitor, bounded by writeTimeout
+// Transient failures are retried per WriteRetry within writeTimeout, retries is how many were made. written is the
+// data sent, the queries of the check look for it. It is zero when the write failed, querying for it then fails with
+// ErrNotWritten without querying
+func (c *Canary) Write(ctx context.Context, writer Writer, target string, requestID string, writeTimeout time.Duration, wg *sync.WaitGroup) (written WriteResult, retries int, err error) {
+	defer wg.Done()
+	m, err := c.monitor()
 	if err != nil {
-		slog.Error("Failed to create meter provider", "error", err)
-		conn.Close()
-		return nil, nil, nil, err
-	}
-
-	// Return shutdown function for cleanup
-	cleanup := func() {
-		if shutdownErr := meterProvider.Shutdown(ctx); shutdownErr != nil {
-			slog.Error("Failed to shut down meter provider", "target", target, "error", shutdownErr)
-		}
-		conn.Close()
+		return WriteResult{}, 0, err
 	}
-
-	canaryMeter := meterProvider.Meter("o11y-canary-exported-data")
-
-	canaryGauge, err := canaryMeter.Float64Gauge(
-		"o11y_canary_canaried_metric_total",
-		metric.WithDescription("o11y canary test metric for canarying"),
-	)
-
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("failed to create metric for write: %v", err)
+	type outcome struct {
+		written WriteResult
+		err     error
 	}
-
-	return meterProvider, cleanup, canaryGauge, nil
-}
-
-// Write performs a write operation for a counter
-// Only records the canaried metric (o11y_canary_canaried_metric_total) via the OTLP meter
-func (c *Canary) Write(ctx context.Context, meterProvider metric.MeterProvider, targets []string, gauge metric.Float64Gauge, requestID string, writeTimeout time.Duration, wg *sync.WaitGroup) (err error) {
-	defer wg.Done()
-	done := make(chan error, 1)
+	var retried atomic.Int32
+	deadline := time.Now().Add(writeTimeout)
+	done := make(chan outcome, 1)
 	go func() {
-		for _, target := range targets {
-
-			// generate metrics
-			randomValue := float64(rand.Intn(100)) // does this need to be random values? i guess why not for later fetching
-			// TODO look at loki canary logic again for their values
-
-			// TODO use something like loki canary streams to help identify the time series by labels?
-			labels := []attribute.KeyValue{
-				attribute.String("target", target),
-				attribute.String("canary", "true"),
-				attribute.String("canary_request_id", requestID),
-			}
-
-			gauge.Record(ctx, randomValue, metric.WithAttributes(labels...))
-
-			slog.Debug("Writing canaried metric", "ingest", target, "canary_request_id", requestID)
-
-			// Force flush metrics after recording
-			if flusher, ok := meterProvider.(interface{ ForceFlush(context.Context) error }); ok {
-				err := flusher.ForceFlush(ctx)
-				if err != nil {
-					slog.Error("Failed to force flush metrics", "error", err)
-				} else {
-					slog.Debug("Force flush succeeded", "canary_request_id", requestID)
-				}
-			} else {
-				slog.Warn("MeterProvider does not support ForceFlush")
-			}
-
-			// TODO - return error and metrics for failed writes better. also return error + metric for timeouts
-
+		var written WriteResult
+		err := c.WriteRetry.do(ctx, "write", deadline, func() { retried.Add(1) }, func() error {
+			var err error
+			written, err = m.Write(ctx, writer, Check{IngestTarget: target, RequestID: requestID, Timeout: writeTimeout})
+			return err
+		})
+		if err != nil {
+			written = WriteResult{}
 		}
-		done <- nil
+		done <- outcome{written: written, err: err}
 	}()
 
 	select {
-	case err := <-done:
-		return err
+	case o := <-done:
+		return o.written, int(retried.Load()), o.err
 	case <-time.After(writeTimeout):
-		err := fmt.Errorf("write operation timed out after %s", writeTimeout)
+		err := &TimeoutError{Operation: "write", Timeout: writeTimeout}
 		slog.Error("Write timeout", "canary_request_id", requestID, "timeout", writeTimeout)
-		c.InsertionTimestamps.Store(requestID, err)
-		return err
+		return WriteResult{}, int(retried.Load()), err
 	}
 }
 
-// Query performs a query operation
-func (c *Canary) Query(ctx context.Context, queryTargets []string, requestID string, queryTimeout time.Duration, tlsConfig *config.TLSConfig, wg *sync.WaitGroup) (err error) {
-	defer wg.Done()
-	done := make(chan error, 1)
-	go func() {
-		var lastErr error
-		for _, target := range queryTargets {
-			slog.Debug("Querying metric", "target", target, "canary_request_id", requestID)
-
-			clientConfig := api.Config{Address: target}
-
-			if tlsConfig != nil && tlsConfig.Enabled {
-				tlsClientConfig := &tls.Config{
-					ServerName:         tlsConfig.ServerName,
-					InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
-					MinVersion:         tls.VersionTLS12,
-				}
-
-				if tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
-					tlsClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
-						cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
-						if err != nil {
-							return nil, fmt.Errorf("failed to load client certificates: %w", err)
-						}
-						return &cert, nil
-					}
-				}
-
-				if tlsConfig.CAFile != "" {
-					caCert, err := os.ReadFile(tlsConfig.CAFile)
-					if err != nil {
-						done <- fmt.Errorf("failed to read CA file: %w", err)
-						return
-					}
-					caCertPool := x509.NewCertPool()
-					if !caCertPool.AppendCertsFromPEM(caCert) {
-						done <- fmt.Errorf("failed to parse CA certificate")
-						return
-					}
-					tlsClientConfig.RootCAs = caCertPool
-				}
-
-				clientConfig.RoundTripper = &http.Transport{
-					TLSClientConfig: tlsClientConfig,
-				}
-			}
+// reservedLabels are set by the canary itself on canaried data or internal metrics and cannot be overridden by additional labels
+var reservedLabels = map[string]bool{
+	"__name__":          true,
+	"target":            true,
+	"canary":            true,
+	"canary_request_id": true,
+	"protocol":          true,
+	"canary_name":       true,
+	"signal":            true,
+	"reason":            true,
+	"ingest_endpoint":   true,
+	"query_endpoint":    true,
+	"tenant":            true,
+	"query_tenant":      true,
+	"operation":         true,
+}
 
-			client, err := api.NewClient(clientConfig)
-			if err != nil {
-				done <- err
-				return
-			}
+// AdditionalAttributes turns additional labels into attributes sorted by key, dropping reserved label names
+func AdditionalAttributes(labels map[string]string) []attribute.KeyValue {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		if reservedLabels[k] {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]attribute.KeyValue, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, attribute.String(k, labels[k]))
+	}
+	return attrs
+}
 
-			api := v1.NewAPI(client)
+// writeSample sends a random value under the canary labels, the result is what the queries of the check verify
+// It is the Write of the built-in monitors, which only differ in the Writer they use
+func (c *Canary) writeSample(ctx context.Context, writer Writer, check Check) (WriteResult, error) {
+	// a wide random range makes the value identify this write when verifying the query result
+	randomValue := float64(rand.Intn(1_000_000))
+	writeTime := time.Now()
+
+	// TODO use something like loki canary streams to help identify the time series by labels?
+	labels := []attribute.KeyValue{
+		attribute.String("target", check.IngestTarget),
+		attribute.String("canary", "true"),
+		attribute.String("canary_request_id", check.RequestID),
+		attribute.String("protocol", writer.Protocol()),
+	}
+	if c.Tenant != "" {
+		labels = append(labels, attribute.String("tenant", c.Tenant))
+	}
+	labels = append(labels, AdditionalAttributes(c.AdditionalLabels)...)
 
-			query := fmt.Sprintf(`o11y_canary_canaried_metric_total{canary="true", canary_request_id="%s"}`, requestID)
+	slog.Debug("Writing canaried data", "ingest", check.IngestTarget, "protocol", writer.Protocol(), "canary_request_id", check.RequestID)
 
-			// Apply per-query timeout via context
-			queryCtx, cancel := context.WithTimeout(ctx, queryTimeout*time.Second)
-			defer cancel()
+	if err := writer.WriteSample(ctx, labels, randomValue, writeTime); err != nil {
+		return WriteResult{}, err
+	}
+	slog.Debug("Write succeeded", "canary_request_id", check.RequestID, "value", randomValue)
+	return WriteResult{Value: randomValue, Timestamp: writeTime}, nil
+}
 
-			// discard result, just want to make sure we can query
-			result, warnings, err := api.Query(queryCtx, query, time.Now())
-			if err != nil {
-				lastErr = err
-				continue
-			}
-			if len(warnings) > 0 {
-				slog.Info("Warning when querying target", "target", target, "canary_request_id", requestID, "warnings", warnings)
-			}
-			if result == nil || result.String() == "" {
-				slog.Warn("Metric not found in query result", "target", target, "canary_request_id", requestID)
-				lastErr = fmt.Errorf("metric not found in query result for target %s with request ID %s", target, requestID)
-				continue
-			}
-			slog.Debug("Query successful", "target", target, "canary_request_id", requestID, "result", result.String())
+// Query performs a query operation through the canary's Monitor against a single query endpoint, looking for the data
+// written through the ingest target
+func (c *Canary) Query(ctx context.Context, endpoint config.Endpoint, ingestTarget string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig, wg *sync.WaitGroup) (err error) {
+	defer wg.Done()
+	_, err = c.query(ctx, endpoint, ingestTarget, requestID, written, queryTimeout, tlsConfig)
+	return err
+}
 
-			// TODO - return error and metrics for failed writes better. also return error + metric for timeouts
-		}
-		done <- lastErr
+// query is Query retrying transient failures per QueryRetry within queryTimeout, retries is how many were made
+// Data that is not visible yet is not retried here, that is up to PollQuery
+func (c *Canary) query(ctx context.Context, endpoint config.Endpoint, ingestTarget string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig) (retries int, err error) {
+	m, err := c.monitor()
+	if err != nil {
+		return 0, err
+	}
+	if written.Timestamp.IsZero() {
+		return 0, fmt.Errorf("nothing written through %s for request ID %s: %w", ingestTarget, requestID, ErrNotWritten)
+	}
+	var retried atomic.Int32
+	deadline := time.Now().Add(queryTimeout)
+	done := make(chan error, 1)
+	go func() {
+		// Apply per-query timeout via context
+		queryCtx, cancel := context.WithDeadline(ctx, deadline)
+		defer cancel()
+		done <- c.QueryRetry.do(queryCtx, "query", deadline, func() { retried.Add(1) }, func() error {
+			_, err := m.Query(queryCtx, endpoint, Check{IngestTarget: ingestTarget, RequestID: requestID, Written: written, Timeout: time.Until(deadline)}, tlsConfig)
+			return err
+		})
 	}()
 
 	select {
 	case err := <-done:
-		return err
+		return int(retried.Load()), err
 	case <-time.After(queryTimeout):
-		err := fmt.Errorf("query operation timed out after %s", queryTimeout)
-		c.InsertionTimestamps.Store(requestID, err)
+		err := &TimeoutError{Operation: "query", Timeout: queryTimeout}
 		slog.Error("Query timeout", "canary_request_id", requestID, "timeout", queryTimeout)
-		return err
-	case <-done:
-		return nil
+		return int(retried.Load()), err
 	}
-
 }
@@ -0,0 +1,152 @@
+package canary
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Failure reasons are the fixed set of causes a failed write or query is classified into, set as the reason label of
+// the error counters and the reason attribute of the failed span so runbooks can branch on them
+const (
+	ReasonDNS           = "dns"
+	ReasonConnect       = "connect"
+	ReasonTLS           = "tls"
+	ReasonAuth          = "auth"
+	ReasonHTTP5xx       = "http_5xx"
+	ReasonHTTP4xx       = "http_4xx"
+	ReasonRateLimited   = "rate_limited"
+	ReasonTimeout       = "timeout"
+	ReasonNotFound      = "not_found"
+	ReasonValueMismatch = "value_mismatch"
+	ReasonWriteFailed   = "write_failed"
+	ReasonQueryFailed   = "query_failed"
+)
+
+// Classify returns the reason a write or query (operation) failed with err
+// The most specific cause wins, so a query that ran out of time on a 502 is http_5xx, but running out of time while the
+// data was not visible yet is a timeout: not_found is only reported when the endpoint answered without the data before
+// the deadline. gRPC status codes are mapped like their HTTP equivalents and a 404 is an http_4xx
+// Failures without a recognizable cause are write_failed or query_failed, e.g. a query result that cannot be decoded
+func Classify(operation string, err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var mismatch *MismatchError
+	var tokenErr *TokenError
+	var statusErr *httpStatusError
+	switch {
+	case errors.As(err, &mismatch):
+		return ReasonValueMismatch
+	case errors.Is(err, ErrNotWritten):
+		return ReasonWriteFailed
+	case errors.Is(err, ErrNotVisible) && isTimeout(err):
+		return ReasonTimeout
+	case errors.Is(err, ErrNotVisible):
+		return ReasonNotFound
+	case errors.As(err, &tokenErr):
+		return ReasonAuth
+	case errors.As(err, &statusErr):
+		return classifyHTTPStatus(statusErr.StatusCode)
+	}
+	if reason := classifyTransport(err); reason != "" {
+		return reason
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.OK && st.Code() != codes.Unknown {
+		return classifyGRPCStatus(st)
+	}
+
+	if isTimeout(err) {
+		return ReasonTimeout
+	}
+	if operation == "write" {
+		return ReasonWriteFailed
+	}
+	return ReasonQueryFailed
+}
+
+// isTimeout reports whether err ran out of time, whatever else it wraps
+func isTimeout(err error) bool {
+	var timeout *TimeoutError
+	var netErr net.Error
+	return errors.As(err, &timeout) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// classifyHTTPStatus maps a non-2xx HTTP status code to a reason
+func classifyHTTPStatus(code int) string {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return ReasonAuth
+	case code == http.StatusTooManyRequests:
+		return ReasonRateLimited
+	case code >= 500:
+		return ReasonHTTP5xx
+	default:
+		return ReasonHTTP4xx
+	}
+}
+
+// classifyTransport recognizes failures to resolve, connect to or handshake with the endpoint, "" when err is none
+func classifyTransport(err error) string {
+	var dnsErr *net.DNSError
+	var verifyErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ReasonTimeout
+		}
+		return ReasonDNS
+	case errors.As(err, &verifyErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return ReasonTLS
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EHOSTUNREACH),
+		errors.Is(err, syscall.ENETUNREACH), errors.Is(err, io.ErrUnexpectedEOF):
+		return ReasonConnect
+	case errors.As(err, &opErr) && opErr.Op == "dial" && !opErr.Timeout():
+		return ReasonConnect
+	}
+	return ""
+}
+
+// classifyGRPCStatus maps a gRPC status to a reason, connection failures only surface in the message of Unavailable
+func classifyGRPCStatus(st *status.Status) string {
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return ReasonAuth
+	case codes.ResourceExhausted:
+		return ReasonRateLimited
+	case codes.DeadlineExceeded:
+		return ReasonTimeout
+	case codes.Unavailable:
+		msg := st.Message()
+		switch {
+		case strings.Contains(msg, "no such host"), strings.Contains(msg, "produced zero addresses"):
+			return ReasonDNS
+		case strings.Contains(msg, "tls:"), strings.Contains(msg, "x509:"), strings.Contains(msg, "authentication handshake failed"):
+			return ReasonTLS
+		case strings.Contains(msg, "connection"), strings.Contains(msg, "dial"):
+			return ReasonConnect
+		}
+		return ReasonHTTP5xx
+	case codes.Internal, codes.DataLoss, codes.Unimplemented, codes.Aborted:
+		return ReasonHTTP5xx
+	default:
+		return ReasonHTTP4xx
+	}
+}
@@ -0,0 +1,69 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"syscall"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		operation string
+		err       error
+		want      string
+	}{
+		{"write", &net.DNSError{Err: "no such host", Name: "otel-collector", IsNotFound: true}, ReasonDNS},
+		{"write", fmt.Errorf("remote write request failed: %w", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), ReasonConnect},
+		{"query", &TokenError{TokenURL: "https://idp/token", Err: errors.New("invalid_client")}, ReasonAuth},
+		{"query", &httpStatusError{Request: "query", StatusCode: http.StatusForbidden}, ReasonAuth},
+		{"write", &httpStatusError{Request: "remote write", StatusCode: http.StatusTooManyRequests}, ReasonRateLimited},
+		{"write", &httpStatusError{Request: "remote write", StatusCode: http.StatusServiceUnavailable}, ReasonHTTP5xx},
+		{"query", &httpStatusError{Request: "query", StatusCode: http.StatusBadRequest}, ReasonHTTP4xx},
+		{"write", &TimeoutError{Operation: "write", Timeout: time.Second}, ReasonTimeout},
+		{"query", fmt.Errorf("metric not found: %w", ErrNotVisible), ReasonNotFound},
+		{"query", &TimeoutError{Operation: "query", Timeout: time.Second, Err: fmt.Errorf("metric not found: %w", ErrNotVisible)}, ReasonTimeout},
+		{"query", fmt.Errorf("metric not found: %w: %w", ErrNotVisible, context.DeadlineExceeded), ReasonTimeout},
+		{"query", &TimeoutError{Operation: "query", Timeout: time.Second, Err: &httpStatusError{StatusCode: http.StatusBadGateway}}, ReasonHTTP5xx},
+		{"query", &MismatchError{Reason: "value"}, ReasonValueMismatch},
+		{"query", fmt.Errorf("no sample written: %w", ErrNotWritten), ReasonWriteFailed},
+		{"write", fmt.Errorf("OTLP logs export failed: %w", status.Error(codes.Unavailable, "connection error: desc = \"transport: Error while dialing: dial tcp 10.0.0.1:4317: connect: connection refused\"")), ReasonConnect},
+		{"write", status.Error(codes.Unavailable, "name resolver error: produced zero addresses"), ReasonDNS},
+		{"write", status.Error(codes.ResourceExhausted, "too many samples"), ReasonRateLimited},
+		{"write", status.Error(codes.Unauthenticated, "missing token"), ReasonAuth},
+		{"write", errors.New("failed to marshal"), ReasonWriteFailed},
+		{"query", fmt.Errorf("failed to decode query response: %w", errors.New("invalid character '<'")), ReasonQueryFailed},
+		{"query", errors.New("unsupported query protocol \"graphite\""), ReasonQueryFailed},
+	}
+	for _, tt := range tests {
+		if got := Classify(tt.operation, tt.err); got != tt.want {
+			t.Errorf("Classify(%s, %v) = %q, want %q", tt.operation, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyTransport(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	// the test server's certificate is not trusted without its CA
+	_, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, config.Auth{})
+	if got := Classify("query", err); got != ReasonTLS {
+		t.Errorf("Expected an untrusted certificate to be tls, got %q for %v", got, err)
+	}
+
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+	_, err = httpGet(context.Background(), closed.URL, "/", nil, time.Second, nil, config.Auth{})
+	if got := Classify("query", err); got != ReasonConnect {
+		t.Errorf("Expected a closed port to be connect, got %q for %v", got, err)
+	}
+}
@@ -0,0 +1,290 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"o11y-canary/internal/config"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/grpc"
+)
+
+// InternalMetricsPusher pushes the canary's own metrics to the internal_metrics endpoint, for replicas that are not
+// scraped. Register Reader with the meter provider of the internal metrics, then call Apply with every configuration
+type InternalMetricsPusher struct {
+	// Reader collects the internal metrics on every push
+	Reader *sdkmetric.ManualReader
+
+	mu      sync.Mutex
+	current *config.InternalMetrics
+	stop    func()
+}
+
+// NewInternalMetricsPusher provides a pusher that does nothing until Apply is called with an endpoint
+func NewInternalMetricsPusher() *InternalMetricsPusher {
+	return &InternalMetricsPusher{Reader: sdkmetric.NewManualReader()}
+}
+
+// Apply starts pushing to cfg, restarting when it differs from the last call and stopping when it is nil
+// When the new endpoint cannot be set up the error is returned and pushing to the previous one continues
+func (p *InternalMetricsPusher) Apply(ctx context.Context, cfg *config.InternalMetrics) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if reflect.DeepEqual(p.current, cfg) {
+		return nil
+	}
+
+	var exporter sdkmetric.Exporter
+	if cfg != nil {
+		var err error
+		exporter, err = newMetricsExporter(ctx, cfg.Endpoint, cfg.Timeout)
+		if err != nil {
+			return fmt.Errorf("failed to set up internal metrics endpoint %s: %w", cfg.URL, err)
+		}
+	}
+	if p.stop != nil {
+		p.stop()
+		p.stop = nil
+	}
+	p.current = cfg
+	if cfg == nil {
+		return nil
+	}
+
+	slog.Info("Pushing internal metrics", "url", cfg.URL, "protocol", cfg.Protocol, "interval", cfg.Interval)
+	runCtx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go p.run(runCtx, exporter, *cfg, done)
+	p.stop = func() {
+		cancel()
+		<-done
+	}
+	return nil
+}
+
+// Endpoints returns the endpoint metrics are currently pushed to, none when pushing is off
+func (p *InternalMetricsPusher) Endpoints() []config.Endpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		return nil
+	}
+	return []config.Endpoint{p.current.Endpoint}
+}
+
+// Stop pushes one last time and stops, so the final values of a replica that shuts down are not lost
+func (p *InternalMetricsPusher) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		p.stop()
+		p.stop = nil
+	}
+	p.current = nil
+}
+
+func (p *InternalMetricsPusher) run(ctx context.Context, exporter sdkmetric.Exporter, cfg config.InternalMetrics, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			p.push(exporter, cfg)
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+			if err := exporter.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Failed to shut down internal metrics exporter", "url", cfg.URL, "error", err)
+			}
+			cancel()
+			return
+		case <-ticker.C:
+			p.push(exporter, cfg)
+		}
+	}
+}
+
+// push collects the internal metrics and exports them, failures are logged as the metrics cannot report themselves
+func (p *InternalMetricsPusher) push(exporter sdkmetric.Exporter, cfg config.InternalMetrics) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	var rm metricdata.ResourceMetrics
+	if err := p.Reader.Collect(ctx, &rm); err != nil {
+		slog.Error("Failed to collect internal metrics", "error", err)
+		return
+	}
+	if err := exporter.Export(ctx, &rm); err != nil {
+		slog.Error("Failed to push internal metrics", "url", cfg.URL, "protocol", cfg.Protocol, "error", err)
+	}
+}
+
+// newMetricsExporter returns an exporter for endpoint by its ingest protocol, the same clients canaried metrics use
+func newMetricsExporter(ctx context.Context, endpoint config.Endpoint, timeout time.Duration) (sdkmetric.Exporter, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolHTTPProtobuf, config.ProtocolHTTPJSON:
+		client, err := newOTLPHTTPClient(endpoint.URL, endpoint.Protocol, endpoint.Compression, timeout, endpoint.TLS, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		return &otlpHTTPExporter{client: client}, nil
+	case config.ProtocolRemoteWrite:
+		writer, err := newRemoteWriteWriter(nil, endpoint.URL, timeout, endpoint.TLS, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		return &remoteWriteExporter{writer: writer}, nil
+	case config.ProtocolGRPC, "":
+		conn, err := newGRPCConn(endpoint.URL, endpoint.Compression, endpoint.TLS, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		exporter, err := otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithGRPCConn(conn))
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to create metrics exporter: %w", err)
+		}
+		return &grpcMetricsExporter{Exporter: exporter, conn: conn}, nil
+	default:
+		return nil, fmt.Errorf("unsupported ingest protocol %q", endpoint.Protocol)
+	}
+}
+
+// grpcMetricsExporter closes the connection it was given, which the OTLP exporter leaves to the caller
+type grpcMetricsExporter struct {
+	sdkmetric.Exporter
+	conn *grpc.ClientConn
+}
+
+// Shutdown shuts down the exporter and closes its connection
+func (e *grpcMetricsExporter) Shutdown(ctx context.Context) error {
+	err := e.Exporter.Shutdown(ctx)
+	e.conn.Close()
+	return err
+}
+
+// remoteWriteExporter is a sdkmetric.Exporter sending the collected metrics as remote write series
+type remoteWriteExporter struct {
+	writer *remoteWriteWriter
+}
+
+var _ sdkmetric.Exporter = (*remoteWriteExporter)(nil)
+
+// Temporality uses the SDK default (cumulative), which is what Prometheus expects
+func (e *remoteWriteExporter) Temporality(k sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(k)
+}
+
+// Aggregation uses the SDK default aggregations
+func (e *remoteWriteExporter) Aggregation(k sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(k)
+}
+
+// Export sends every data point in one write request
+func (e *remoteWriteExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	series := resourceMetricsToSeries(rm)
+	if len(series) == 0 {
+		return nil
+	}
+	return e.writer.send(ctx, series)
+}
+
+// ForceFlush is a no-op, every Export is sent synchronously
+func (e *remoteWriteExporter) ForceFlush(context.Context) error {
+	return nil
+}
+
+// Shutdown releases idle connections
+func (e *remoteWriteExporter) Shutdown(context.Context) error {
+	e.writer.Close()
+	return nil
+}
+
+// resourceMetricsToSeries converts data points the way the Prometheus exporter does: service.name becomes job,
+// service.instance.id becomes instance and histograms become _bucket, _sum and _count series
+func resourceMetricsToSeries(rm *metricdata.ResourceMetrics) []prompbSeries {
+	var target []prompbLabel
+	if rm.Resource != nil {
+		if v, ok := rm.Resource.Set().Value(semconv.ServiceNameKey); ok {
+			target = append(target, prompbLabel{Name: "job", Value: v.AsString()})
+		}
+		if v, ok := rm.Resource.Set().Value(semconv.ServiceInstanceIDKey); ok {
+			target = append(target, prompbLabel{Name: "instance", Value: v.AsString()})
+		}
+	}
+
+	var out []prompbSeries
+	add := func(name string, attrs attribute.Set, value float64, ts time.Time, extra ...prompbLabel) {
+		labels := append([]prompbLabel{{Name: "__name__", Value: name}}, target...)
+		for _, kv := range attrs.ToSlice() {
+			labels = append(labels, prompbLabel{Name: sanitizeLabelName(string(kv.Key)), Value: kv.Value.Emit()})
+		}
+		labels = append(labels, extra...)
+		out = append(out, prompbSeries{Labels: labels, Value: value, TimestampMs: ts.UnixMilli()})
+	}
+
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			switch data := m.Data.(type) {
+			case metricdata.Gauge[int64]:
+				addPoints(add, m.Name, data.DataPoints)
+			case metricdata.Gauge[float64]:
+				addPoints(add, m.Name, data.DataPoints)
+			case metricdata.Sum[int64]:
+				addPoints(add, m.Name, data.DataPoints)
+			case metricdata.Sum[float64]:
+				addPoints(add, m.Name, data.DataPoints)
+			case metricdata.Histogram[int64]:
+				addHistogram(add, m.Name, data.DataPoints)
+			case metricdata.Histogram[float64]:
+				addHistogram(add, m.Name, data.DataPoints)
+			default:
+				slog.Debug("Skipping unsupported internal metric type", "name", m.Name, "type", fmt.Sprintf("%T", m.Data))
+			}
+		}
+	}
+	return out
+}
+
+type addSeriesFunc func(name string, attrs attribute.Set, value float64, ts time.Time, extra ...prompbLabel)
+
+func addPoints[N int64 | float64](add addSeriesFunc, name string, points []metricdata.DataPoint[N]) {
+	for _, dp := range points {
+		add(name, dp.Attributes, float64(dp.Value), dp.Time)
+	}
+}
+
+func addHistogram[N int64 | float64](add addSeriesFunc, name string, points []metricdata.HistogramDataPoint[N]) {
+	for _, dp := range points {
+		var cumulative uint64
+		for i, bound := range dp.Bounds {
+			cumulative += dp.BucketCounts[i]
+			add(name+"_bucket", dp.Attributes, float64(cumulative), dp.Time, prompbLabel{Name: "le", Value: strconv.FormatFloat(bound, 'g', -1, 64)})
+		}
+		add(name+"_bucket", dp.Attributes, float64(dp.Count), dp.Time, prompbLabel{Name: "le", Value: "+Inf"})
+		add(name+"_sum", dp.Attributes, float64(dp.Sum), dp.Time)
+		add(name+"_count", dp.Attributes, float64(dp.Count), dp.Time)
+	}
+}
+
+// sanitizeLabelName replaces characters Prometheus does not allow in label names, e.g. the dots of OTel attributes
+func sanitizeLabelName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,115 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+func TestInternalMetricsPusher(t *testing.T) {
+	var pushes atomic.Int32
+	var last atomic.Pointer[[]byte]
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		decoded, err := snappy.Decode(nil, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		last.Store(&decoded)
+		pushes.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	pusher := NewInternalMetricsPusher()
+	res := resource.NewSchemaless(semconv.ServiceNameKey.String("o11y-canary"), semconv.ServiceInstanceIDKey.String("replica-1"))
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(pusher.Reader), sdkmetric.WithResource(res)).Meter("test")
+	counter, _ := meter.Int64Counter("o11y_canary_test_total")
+	counter.Add(context.Background(), 3, metric.WithAttributes(attribute.String("canary_name", "prom")))
+
+	cfg := &config.InternalMetrics{
+		Endpoint: config.Endpoint{URL: srv.URL + "/api/v1/write", Protocol: config.ProtocolRemoteWrite},
+		Interval: 20 * time.Millisecond,
+		Timeout:  time.Second,
+	}
+	if err := pusher.Apply(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for pushes.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pushes.Load() == 0 {
+		t.Fatalf("Expected the internal metrics to be pushed")
+	}
+	body := *last.Load()
+	for _, want := range []string{"o11y_canary_test_total", "canary_name", "replica-1", "job"} {
+		if !bytes.Contains(body, []byte(want)) {
+			t.Errorf("Expected the pushed series to contain %q", want)
+		}
+	}
+
+	// applying the same configuration again keeps the running pusher
+	if err := pusher.Apply(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	pusher.Stop()
+	stopped := pushes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if pushes.Load() != stopped {
+		t.Errorf("Expected no pushes after Stop")
+	}
+}
+
+func TestResourceMetricsToSeries(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	meter := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader), sdkmetric.WithResource(resource.Empty())).Meter("test")
+	hist, _ := meter.Float64Histogram("o11y_canary_test_seconds", metric.WithExplicitBucketBoundaries(0.1, 1))
+	hist.Record(context.Background(), 0.05, metric.WithAttributes(attribute.String("service.name", "x")))
+	hist.Record(context.Background(), 0.5, metric.WithAttributes(attribute.String("service.name", "x")))
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, s := range resourceMetricsToSeries(&rm) {
+		key := ""
+		for _, l := range s.Labels {
+			if l.Name == "service.name" {
+				t.Errorf("Expected attribute names to be sanitized, got %q", l.Name)
+			}
+			if l.Name == "__name__" || l.Name == "le" {
+				key += l.Value + " "
+			}
+		}
+		got[key] = s.Value
+	}
+	want := map[string]float64{
+		"o11y_canary_test_seconds_bucket 0.1 ":  1,
+		"o11y_canary_test_seconds_bucket 1 ":    2,
+		"o11y_canary_test_seconds_bucket +Inf ": 2,
+		"o11y_canary_test_seconds_sum ":         0.55,
+		"o11y_canary_test_seconds_count ":       2,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("Expected %s= %v, got %v", k, v, got[k])
+		}
+	}
+}
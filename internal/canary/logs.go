@@ -0,0 +1,395 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+)
+
+// canariedLogMessage starts every canaried log line
+const canariedLogMessage = "o11y canary log"
+
+func init() {
+	RegisterMonitor(config.TypeLogs, func(c *Canary) Monitor { return &logsMonitor{c: c} })
+}
+
+// logsMonitor writes canaried log lines and finds them again with LogQL or LogsQL
+type logsMonitor struct {
+	c *Canary
+}
+
+// NewWriter picks the log client by ingest protocol
+func (m *logsMonitor) NewWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	return newLogWriter(res, endpoint, timeout, tlsConfig)
+}
+
+// Write emits a canaried log line carrying a random value
+func (m *logsMonitor) Write(ctx context.Context, writer Writer, check Check) (WriteResult, error) {
+	return m.c.writeSample(ctx, writer, check)
+}
+
+// Query searches the log line of the check by its request ID
+func (m *logsMonitor) Query(ctx context.Context, endpoint config.Endpoint, check Check, tlsConfig *config.TLSConfig) (QueryResult, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolLoki, "":
+		return QueryResult{}, m.c.queryLoki(ctx, endpoint.URL, check.IngestTarget, check.RequestID, check.Written, check.Timeout, tlsConfig, endpoint.Auth)
+	case config.ProtocolLogsQL:
+		return QueryResult{}, m.c.queryLogsQL(ctx, endpoint.URL, check.IngestTarget, check.RequestID, check.Written, check.Timeout, tlsConfig, endpoint.Auth)
+	default:
+		return QueryResult{}, fmt.Errorf("unsupported query protocol %q for logs", endpoint.Protocol)
+	}
+}
+
+// newLogWriter returns a Writer emitting canaried log lines with OTLP or the Loki push API
+func newLogWriter(res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolGRPC, "":
+		conn, err := newGRPCConn(endpoint.URL, endpoint.Compression, tlsConfig, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		return &otlpLogWriter{
+			protocol:   config.ProtocolGRPC,
+			resource:   resourceToProto(res),
+			conn:       conn,
+			grpcClient: collogspb.NewLogsServiceClient(conn),
+		}, nil
+	case config.ProtocolHTTPProtobuf, config.ProtocolHTTPJSON:
+		client, err := newOTLPHTTPClient(endpoint.URL, endpoint.Protocol, endpoint.Compression, timeout, tlsConfig, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		return &otlpLogWriter{
+			protocol:   endpoint.Protocol,
+			resource:   resourceToProto(res),
+			httpClient: client,
+		}, nil
+	case config.ProtocolLoki:
+		return newLokiWriter(res, endpoint.URL, timeout, tlsConfig, endpoint.Auth)
+	default:
+		return nil, fmt.Errorf("unsupported ingest protocol %q for logs", endpoint.Protocol)
+	}
+}
+
+// logLine renders the canaried labels and value as a logfmt line so LogQL and LogsQL line filters can find the request ID
+func logLine(labels []attribute.KeyValue, value float64) string {
+	var b strings.Builder
+	b.WriteString(canariedLogMessage)
+	for _, kv := range labels {
+		fmt.Fprintf(&b, " %s=%s", kv.Key, kv.Value.Emit())
+	}
+	fmt.Fprintf(&b, " value=%s", strconv.FormatFloat(value, 'f', -1, 64))
+	return b.String()
+}
+
+// otlpLogWriter sends one OTLP log record per canaried sample
+type otlpLogWriter struct {
+	protocol   string
+	resource   *resourcepb.Resource
+	conn       *grpc.ClientConn
+	grpcClient collogspb.LogsServiceClient
+	httpClient *otlpHTTPClient
+}
+
+// WriteSample exports a single log record carrying the labels as attributes
+func (w *otlpLogWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	now := uint64(ts.UnixNano())
+	req := &collogspb.ExportLogsServiceRequest{
+		ResourceLogs: []*logspb.ResourceLogs{{
+			Resource: w.resource,
+			ScopeLogs: []*logspb.ScopeLogs{{
+				Scope: &commonpb.InstrumentationScope{Name: "o11y-canary-exported-data"},
+				LogRecords: []*logspb.LogRecord{{
+					TimeUnixNano:         now,
+					ObservedTimeUnixNano: now,
+					SeverityNumber:       logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+					SeverityText:         "INFO",
+					Body:                 &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: logLine(labels, value)}},
+					Attributes:           attributesToProto(labels),
+				}},
+			}},
+		}},
+	}
+
+	if w.grpcClient != nil {
+		_, err := w.grpcClient.Export(ctx, req)
+		if err != nil {
+			return fmt.Errorf("OTLP logs export failed: %w", err)
+		}
+		return nil
+	}
+	return w.httpClient.export(ctx, "logs", req, &collogspb.ExportLogsServiceResponse{})
+}
+
+// Protocol returns the OTLP transport
+func (w *otlpLogWriter) Protocol() string {
+	return w.protocol
+}
+
+// Close releases the grpc connection or idle http connections
+func (w *otlpLogWriter) Close() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	if w.httpClient != nil {
+		w.httpClient.client.CloseIdleConnections()
+	}
+}
+
+// lokiWriter pushes canaried log lines with the Loki push API (JSON)
+type lokiWriter struct {
+	url    string
+	job    string
+	client *http.Client
+}
+
+type lokiPushRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func newLokiWriter(res *resource.Resource, target string, timeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) (*lokiWriter, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Loki endpoint %q: %w", target, err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/loki/api/v1/push"
+	}
+
+	client, err := newHTTPClient(target, timeout, tlsConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	job := ""
+	if res != nil {
+		if v, ok := res.Set().Value(semconv.ServiceNameKey); ok {
+			job = v.AsString()
+		}
+	}
+
+	slog.Debug("Setting up Loki push client", "target", u.String(), "tls_enabled", tlsConfig != nil && tlsConfig.Enabled)
+
+	return &lokiWriter{url: u.String(), job: job, client: client}, nil
+}
+
+// WriteSample pushes one line, the request ID stays out of the stream labels to keep Loki cardinality low
+func (w *lokiWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	stream := map[string]string{}
+	if w.job != "" {
+		stream["service_name"] = w.job
+	}
+	for _, kv := range labels {
+		if kv.Key == "canary_request_id" {
+			continue
+		}
+		stream[string(kv.Key)] = kv.Value.Emit()
+	}
+
+	body, err := json.Marshal(lokiPushRequest{Streams: []lokiStream{{
+		Stream: stream,
+		Values: [][2]string{{strconv.FormatInt(ts.UnixNano(), 10), logLine(labels, value)}},
+	}}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal Loki push request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Loki push request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "o11y-canary")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("loki push request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return newHTTPStatusError("loki push", resp, msg)
+	}
+	return nil
+}
+
+// Protocol returns loki
+func (w *lokiWriter) Protocol() string {
+	return config.ProtocolLoki
+}
+
+// Close releases idle connections
+func (w *lokiWriter) Close() {
+	w.client.CloseIdleConnections()
+}
+
+type lokiQueryResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// queryStart is the lower bound for log and trace searches, just before the data was written
+func queryStart(written WriteResult) time.Time {
+	return written.Timestamp.Add(-time.Second)
+}
+
+// queryLoki searches for the canaried line written through the ingest target with LogQL through query_range
+func (c *Canary) queryLoki(ctx context.Context, target string, ingestTarget string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) error {
+	slog.Debug("Querying logs", "target", target, "ingest", ingestTarget, "protocol", config.ProtocolLoki, "canary_request_id", requestID)
+
+	// the target is followed by more labels in the line, the trailing space keeps one URL from matching another it prefixes
+	query := fmt.Sprintf(`{service_name=%q} |= %q |= %q`, c.Name, "canary_request_id="+requestID, "target="+ingestTarget+" ")
+	if c.Tenant != "" {
+		query += fmt.Sprintf(` |= %q`, "tenant="+c.Tenant+" ")
+	}
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("start", strconv.FormatInt(queryStart(written).UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(time.Now().UnixNano(), 10))
+	params.Set("limit", "1")
+	params.Set("direction", "backward")
+
+	body, err := httpGet(ctx, target, "/loki/api/v1/query_range", params, queryTimeout, tlsConfig, auth)
+	if err != nil {
+		return err
+	}
+
+	var resp lokiQueryResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("failed to decode Loki response: %w", err)
+	}
+	if resp.Status != "success" {
+		return fmt.Errorf("loki query returned status %q", resp.Status)
+	}
+	for _, stream := range resp.Data.Result {
+		if len(stream.Values) > 0 {
+			slog.Debug("Query successful", "target", target, "canary_request_id", requestID, "line", stream.Values[0][1])
+			return nil
+		}
+	}
+
+	slog.Warn("Log line not found in query result", "target", target, "canary_request_id", requestID)
+	return fmt.Errorf("log line not found in query result for target %s with request ID %s: %w", target, requestID, ErrNotVisible)
+}
+
+// queryLogsQL searches for the canaried line written through the ingest target with LogsQL phrase filters on VictoriaLogs
+func (c *Canary) queryLogsQL(ctx context.Context, target string, ingestTarget string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) error {
+	slog.Debug("Querying logs", "target", target, "ingest", ingestTarget, "protocol", config.ProtocolLogsQL, "canary_request_id", requestID)
+
+	// phrase filters only need word boundaries around the phrase, so target=http://a would also match http://a:8080,
+	// a regexp with the trailing space matches the target exactly like the Loki query does
+	params := url.Values{}
+	query := strconv.Quote("canary_request_id="+requestID) + " ~" + strconv.Quote(regexp.QuoteMeta("target="+ingestTarget+" "))
+	if c.Tenant != "" {
+		query += " ~" + strconv.Quote(regexp.QuoteMeta("tenant="+c.Tenant+" "))
+	}
+	params.Set("query", query)
+	params.Set("start", queryStart(written).Format(time.RFC3339Nano))
+	params.Set("limit", "1")
+
+	body, err := httpGet(ctx, target, "/select/logsql/query", params, queryTimeout, tlsConfig, auth)
+	if err != nil {
+		return err
+	}
+
+	// the response is one JSON object per matching line
+	line := strings.TrimSpace(string(body))
+	if line == "" {
+		slog.Warn("Log line not found in query result", "target", target, "canary_request_id", requestID)
+		return fmt.Errorf("log line not found in query result for target %s with request ID %s: %w", target, requestID, ErrNotVisible)
+	}
+	slog.Debug("Query successful", "target", target, "canary_request_id", requestID, "line", line)
+	return nil
+}
+
+// httpGet issues a GET against path below the endpoint URL and returns the body of a 2xx response
+func httpGet(ctx context.Context, target string, path string, params url.Values, timeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) ([]byte, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse query endpoint %q: %w", target, err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawQuery = params.Encode()
+
+	client, err := newHTTPClient(target, timeout, tlsConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "o11y-canary")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, newHTTPStatusError("query", resp, body)
+	}
+	return body, nil
+}
+
+// httpStatusError is returned by httpGet and the HTTP writers for non-2xx responses
+type httpStatusError struct {
+	// Request names what was sent, e.g. query or remote write
+	Request    string
+	StatusCode int
+	Status     string
+	Body       string
+	// RetryAfter is the wait the endpoint asked for with a Retry-After header, if any
+	RetryAfter time.Duration
+}
+
+func newHTTPStatusError(request string, resp *http.Response, body []byte) *httpStatusError {
+	return &httpStatusError{
+		Request:    request,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("%s returned status %s: %s", e.Request, e.Status, e.Body)
+}
@@ -0,0 +1,169 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+)
+
+// logsQLFilter matches the phrase and regexp filters of a LogsQL query
+var logsQLFilter = regexp.MustCompile(`(~?)("(?:[^"\\]|\\.)*")`)
+
+// fakeLoki stores pushed lines and answers query_range with a line filter, and LogsQL queries like VictoriaLogs
+type fakeLoki struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/loki/api/v1/push":
+		var req lokiPushRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, s := range req.Streams {
+			if _, ok := s.Stream["canary_request_id"]; ok {
+				http.Error(w, "request id must not be a stream label", http.StatusBadRequest)
+				return
+			}
+			for _, v := range s.Values {
+				f.lines = append(f.lines, v[1])
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case "/loki/api/v1/query_range":
+		query := r.URL.Query().Get("query")
+		filters := strings.Split(query, " |= ")[1:]
+		values := []string{}
+		for _, line := range f.lines {
+			matches := true
+			for _, filter := range filters {
+				phrase, _ := strconv.Unquote(filter)
+				matches = matches && strings.Contains(line, phrase)
+			}
+			if matches {
+				values = append(values, fmt.Sprintf(`["1","%s"]`, line))
+			}
+		}
+		result := "[]"
+		if len(values) > 0 {
+			result = fmt.Sprintf(`[{"stream":{},"values":[%s]}]`, strings.Join(values, ","))
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"streams","result":%s}}`, result)
+	case "/select/logsql/query":
+		filters := logsQLFilter.FindAllStringSubmatch(r.URL.Query().Get("query"), -1)
+		for _, line := range f.lines {
+			matches := true
+			for _, filter := range filters {
+				phrase, _ := strconv.Unquote(filter[2])
+				if filter[1] == "~" {
+					matched, _ := regexp.MatchString(phrase, line)
+					matches = matches && matched
+				} else {
+					matches = matches && strings.Contains(line, phrase)
+				}
+			}
+			if matches {
+				fmt.Fprintf(w, "{\"_msg\":%q}\n", line)
+			}
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLokiRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(&fakeLoki{})
+	defer srv.Close()
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("logs_canary"))
+	c := Canary{Name: "logs_canary", Type: config.TypeLogs}
+
+	w, err := c.InitClient(context.Background(), res, config.Endpoint{URL: srv.URL, Protocol: config.ProtocolLoki}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), w, srv.URL, "abc123", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolLoki}
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, srv.URL, "abc123", written, time.Second, nil, &wg); err != nil {
+		t.Errorf("Expected written line to be found, got %v", err)
+	}
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, srv.URL, "missing", written, time.Second, nil, &wg); err == nil {
+		t.Errorf("Expected error for unknown request ID")
+	}
+	// every ingest and query pair is its own path, a line written through one collector says nothing about another
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, srv.URL+"/other", "abc123", written, time.Second, nil, &wg); err == nil {
+		t.Errorf("Expected error for a line written through another ingest target")
+	}
+}
+
+func TestLogsQLExactTarget(t *testing.T) {
+	srv := httptest.NewServer(&fakeLoki{})
+	defer srv.Close()
+
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String("logs_canary"))
+	c := Canary{Name: "logs_canary", Type: config.TypeLogs}
+	w, err := c.InitClient(context.Background(), res, config.Endpoint{URL: srv.URL, Protocol: config.ProtocolLoki}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), w, "http://collector:4318", "abc123", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolLogsQL}
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, "http://collector:4318", "abc123", written, time.Second, nil, &wg); err != nil {
+		t.Errorf("Expected written line to be found, got %v", err)
+	}
+	// the target written through starts with this one, but is another path
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, "http://collector", "abc123", written, time.Second, nil, &wg); !errors.Is(err, ErrNotVisible) {
+		t.Errorf("Expected no match for a target prefixing the one written through, got %v", err)
+	}
+}
+
+func TestLogLine(t *testing.T) {
+	line := logLine([]attribute.KeyValue{
+		attribute.String("canary", "true"),
+		attribute.String("canary_request_id", "abc"),
+	}, 12)
+	expected := "o11y canary log canary=true canary_request_id=abc value=12"
+	if line != expected {
+		t.Errorf("Expected %q, got %q", expected, line)
+	}
+}
@@ -0,0 +1,164 @@
+package canary
+
+import (
+	"context"
+	"log/slog"
+	"o11y-canary/internal/config"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// RunFunc runs a single canary until ctx is cancelled
+type RunFunc func(ctx context.Context, name string, cfg config.CanaryConfig)
+
+// Manager keeps one running canary per configured name and applies configuration changes by diffing
+// Unchanged canaries keep running, so their series and in-flight checks survive a reload
+type Manager struct {
+	ctx context.Context
+	run RunFunc
+	// applyMu serializes Apply, which waits for stopped canaries to return without holding mu
+	applyMu sync.Mutex
+	mu      sync.Mutex
+	running map[string]*managedCanary
+	wg      sync.WaitGroup
+}
+
+// managedCanary is a canary started by the Manager
+type managedCanary struct {
+	cfg    config.CanaryConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ApplyResult lists the canaries touched by Manager.Apply, sorted by name
+type ApplyResult struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// NewManager provides a Manager running canaries with run below ctx
+func NewManager(ctx context.Context, run RunFunc) *Manager {
+	return &Manager{ctx: ctx, run: run, running: map[string]*managedCanary{}}
+}
+
+// Apply starts added canaries, stops removed ones and restarts the ones whose configuration changed
+// Stopped canaries have returned from their RunFunc before Apply returns and before their replacements start. They are
+// all cancelled at once, so their in-flight queries wind down together, and waiting for them does not block Names.
+// The state kept per endpoint, like its HTTP transport and the certificate chain it presented, is dropped for
+// endpoints neither the canaries nor keep use any more
+func (m *Manager) Apply(canaries map[string]config.CanaryConfig, keep ...config.Endpoint) ApplyResult {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+
+	var result ApplyResult
+	var stopped []*managedCanary
+	m.mu.Lock()
+	for name, mc := range m.running {
+		cfg, ok := canaries[name]
+		switch {
+		case !ok:
+			result.Removed = append(result.Removed, name)
+		case !reflect.DeepEqual(cfg, mc.cfg), mc.exited():
+			// a canary that gave up, e.g. on an unreachable endpoint at startup, gets another go on reload
+			result.Changed = append(result.Changed, name)
+		default:
+			continue
+		}
+		mc.cancel()
+		stopped = append(stopped, mc)
+		delete(m.running, name)
+	}
+	m.mu.Unlock()
+	for _, mc := range stopped {
+		<-mc.done
+	}
+
+	m.mu.Lock()
+	for name, cfg := range canaries {
+		if _, ok := m.running[name]; ok {
+			continue
+		}
+		if !slices.Contains(result.Changed, name) {
+			result.Added = append(result.Added, name)
+		}
+		m.start(name, cfg)
+	}
+	m.mu.Unlock()
+
+	pruneEndpoints(endpointKeys(canaries, keep))
+
+	sort.Strings(result.Added)
+	sort.Strings(result.Removed)
+	sort.Strings(result.Changed)
+	slog.Info("Applied canary configuration", "added", result.Added, "removed", result.Removed, "changed", result.Changed)
+	return result
+}
+
+// endpointKeys returns the endpointKey of every endpoint the canaries write to or query, as each of their tenants, and
+// of keep. Endpoints without TLS settings use the canary ones, like the clients built for them
+func endpointKeys(canaries map[string]config.CanaryConfig, keep []config.Endpoint) map[string]bool {
+	keys := map[string]bool{}
+	for _, cfg := range canaries {
+		tenants := cfg.Tenants
+		if len(tenants) == 0 {
+			tenants = []config.Tenant{{}}
+		}
+		for _, endpoint := range slices.Concat(cfg.Ingest, cfg.Query) {
+			tlsConfig := endpoint.TLS
+			if tlsConfig == nil {
+				tlsConfig = cfg.TLS
+			}
+			for _, tenant := range tenants {
+				keys[endpointKey(tenant.Endpoint(endpoint).URL, tlsConfig)] = true
+			}
+		}
+	}
+	for _, endpoint := range keep {
+		keys[endpointKey(endpoint.URL, endpoint.TLS)] = true
+	}
+	return keys
+}
+
+// Names returns the sorted names of the running canaries
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.running))
+	for name := range m.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exited reports whether the canary's RunFunc has returned
+func (mc *managedCanary) exited() bool {
+	select {
+	case <-mc.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until every canary has returned, which happens once the manager's context is cancelled
+func (m *Manager) Wait() {
+	m.wg.Wait()
+}
+
+// start runs the canary in its own goroutine with a context that Apply can cancel, m.mu must be held
+func (m *Manager) start(name string, cfg config.CanaryConfig) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	mc := &managedCanary{cfg: cfg, cancel: cancel, done: make(chan struct{})}
+	m.running[name] = mc
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(mc.done)
+		defer cancel()
+		m.run(ctx, name, cfg)
+	}()
+}
@@ -0,0 +1,94 @@
+package canary
+
+import (
+	"context"
+	"o11y-canary/internal/config"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManagerApply(t *testing.T) {
+	var mu sync.Mutex
+	starts := map[string]int{}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewManager(ctx, func(ctx context.Context, name string, cfg config.CanaryConfig) {
+		mu.Lock()
+		starts[name]++
+		mu.Unlock()
+		if name == "broken" {
+			return
+		}
+		<-ctx.Done()
+	})
+
+	result := m.Apply(map[string]config.CanaryConfig{
+		"a":      {Interval: time.Second},
+		"b":      {Interval: time.Second},
+		"broken": {Interval: time.Second},
+	})
+	if !reflect.DeepEqual(result.Added, []string{"a", "b", "broken"}) {
+		t.Errorf("Expected all canaries added, got %+v", result)
+	}
+
+	// give the broken canary time to exit on its own
+	time.Sleep(50 * time.Millisecond)
+
+	result = m.Apply(map[string]config.CanaryConfig{
+		"a":      {Interval: time.Second},
+		"b":      {Interval: 2 * time.Second},
+		"c":      {Interval: time.Second},
+		"broken": {Interval: time.Second},
+	})
+	expected := ApplyResult{Added: []string{"c"}, Changed: []string{"b", "broken"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, result)
+	}
+
+	result = m.Apply(map[string]config.CanaryConfig{"c": {Interval: time.Second}})
+	if !reflect.DeepEqual(result.Removed, []string{"a", "b", "broken"}) {
+		t.Errorf("Expected a, b and broken removed, got %+v", result)
+	}
+	if names := m.Names(); !reflect.DeepEqual(names, []string{"c"}) {
+		t.Errorf("Expected only c running, got %v", names)
+	}
+
+	cancel()
+	m.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expectedStarts := map[string]int{"a": 1, "b": 2, "c": 1, "broken": 2}
+	if !reflect.DeepEqual(starts, expectedStarts) {
+		t.Errorf("Expected starts %v, got %v", expectedStarts, starts)
+	}
+}
+
+func TestManagerApplySlowStop(t *testing.T) {
+	// every canary takes a while to return once cancelled, like one draining its in-flight queries
+	stopDelay := 200 * time.Millisecond
+	m := NewManager(context.Background(), func(ctx context.Context, name string, cfg config.CanaryConfig) {
+		<-ctx.Done()
+		time.Sleep(stopDelay)
+	})
+	m.Apply(map[string]config.CanaryConfig{"a": {}, "b": {}, "c": {}})
+
+	applied := make(chan struct{})
+	start := time.Now()
+	go func() {
+		defer close(applied)
+		m.Apply(map[string]config.CanaryConfig{"c": {}})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if names := m.Names(); !reflect.DeepEqual(names, []string{"c"}) {
+		t.Errorf("Expected only c running while a and b stop, got %v", names)
+	}
+	if elapsed := time.Since(start); elapsed > stopDelay/2 {
+		t.Errorf("Expected Names not to wait for the stopping canaries, took %s", elapsed)
+	}
+	<-applied
+	if elapsed := time.Since(start); elapsed < stopDelay || elapsed > stopDelay*3/2 {
+		t.Errorf("Expected a and b to stop together within %s, took %s", stopDelay, elapsed)
+	}
+}
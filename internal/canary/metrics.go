@@ -0,0 +1,269 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"o11y-canary/internal/config"
+	"o11y-canary/pkg/otelsetup"
+	"time"
+
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+func init() {
+	RegisterMonitor(config.TypeMetrics, func(c *Canary) Monitor { return &metricsMonitor{c: c} })
+}
+
+// metricsMonitor writes the canaried gauge over OTLP or remote write and reads it back with PromQL
+type metricsMonitor struct {
+	c *Canary
+}
+
+// NewWriter picks the metrics client by ingest protocol
+func (m *metricsMonitor) NewWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolGRPC, config.ProtocolHTTPProtobuf, config.ProtocolHTTPJSON, "":
+		return newOTLPWriter(ctx, res, endpoint, timeout, tlsConfig)
+	case config.ProtocolRemoteWrite:
+		return newRemoteWriteWriter(res, endpoint.URL, timeout, tlsConfig, endpoint.Auth)
+	default:
+		return nil, fmt.Errorf("unsupported ingest protocol %q", endpoint.Protocol)
+	}
+}
+
+// Write records a random value on the canaried gauge
+func (m *metricsMonitor) Write(ctx context.Context, writer Writer, check Check) (WriteResult, error) {
+	return m.c.writeSample(ctx, writer, check)
+}
+
+// Query finds the written sample through the Prometheus query API
+func (m *metricsMonitor) Query(ctx context.Context, endpoint config.Endpoint, check Check, tlsConfig *config.TLSConfig) (QueryResult, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolPrometheus, "":
+		return m.c.queryPrometheus(ctx, endpoint.URL, check.IngestTarget, check.RequestID, check.Written, tlsConfig, endpoint.Auth)
+	default:
+		return QueryResult{}, fmt.Errorf("unsupported query protocol %q for metrics", endpoint.Protocol)
+	}
+}
+
+// otlpWriter writes the canaried gauge through an OTLP meter provider
+type otlpWriter struct {
+	protocol      string
+	meterProvider *sdkmetric.MeterProvider
+	gauge         metric.Float64Gauge
+	cleanup       func()
+}
+
+// newOTLPWriter provides the OTLP client, meterprovider (with shutdown func), and metrics for later writing
+func newOTLPWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (*otlpWriter, error) {
+	target := endpoint.URL
+	protocol := endpoint.Protocol
+	if protocol == "" {
+		protocol = config.ProtocolGRPC
+	}
+
+	if protocol == config.ProtocolHTTPProtobuf || protocol == config.ProtocolHTTPJSON {
+		client, err := newOTLPHTTPClient(target, protocol, endpoint.Compression, timeout, tlsConfig, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		meterProvider := otelsetup.InitMeterProviderWithExporter(res, &otlpHTTPExporter{client: client}, timeout)
+		cleanup := func() {
+			if shutdownErr := meterProvider.Shutdown(ctx); shutdownErr != nil {
+				slog.Error("Failed to shut down meter provider", "target", target, "error", shutdownErr)
+			}
+		}
+		return newOTLPGaugeWriter(protocol, meterProvider, cleanup)
+	}
+
+	conn, err := newGRPCConn(target, endpoint.Compression, tlsConfig, endpoint.Auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// TODO - dynamic CLI flags for connection, target, etc
+	meterProvider, err := otelsetup.InitOTLPMeterProvider(ctx, res, conn, timeout)
+	if err != nil {
+		slog.Error("Failed to create meter provider", "error", err)
+		conn.Close()
+		return nil, err
+	}
+
+	// Return shutdown function for cleanup
+	cleanup := func() {
+		if shutdownErr := meterProvider.Shutdown(ctx); shutdownErr != nil {
+			slog.Error("Failed to shut down meter provider", "target", target, "error", shutdownErr)
+		}
+		conn.Close()
+	}
+
+	return newOTLPGaugeWriter(protocol, meterProvider, cleanup)
+}
+
+// newGRPCConn dials an OTLP gRPC endpoint with optional TLS, auth and compression
+func newGRPCConn(target string, compression string, tlsConfig *config.TLSConfig, auth config.Auth) (*grpc.ClientConn, error) {
+	// the credentials read the current TLS files on every handshake, so reconnects pick up rotated certificates
+	var creds credentials.TransportCredentials
+	if tlsConfig != nil && tlsConfig.Enabled {
+		var err error
+		creds, err = newTransportCredentials(target, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		creds = insecure.NewCredentials()
+	}
+
+	// stats handler provides automatic grpc (rpc_) metrics
+	slog.Debug("Setting up gRPC client", "target", target, "tls_enabled", tlsConfig != nil && tlsConfig.Enabled)
+	if tlsConfig != nil && tlsConfig.Enabled {
+		slog.Debug("gRPC TLS config", "server_name", tlsConfig.ServerName, "insecure_skip_verify", tlsConfig.InsecureSkipVerify, "cert_file", tlsConfig.CertFile, "key_file", tlsConfig.KeyFile, "ca_file", tlsConfig.CAFile)
+	}
+	dialOpts := []grpc.DialOption{
+		grpc.WithTransportCredentials(creds),
+		grpc.WithStatsHandler(otelgrpc.NewClientHandler()),
+		// rejected data must fail the write, not just show up in the collector's response
+		grpc.WithChainUnaryInterceptor(partialSuccessInterceptor),
+	}
+	if hasAuth(auth) {
+		dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(grpcAuthInterceptor(auth)))
+	}
+	// compression options on the exporter are ignored when handing it our own connection
+	if compression == config.CompressionGzip {
+		dialOpts = append(dialOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+	}
+	conn, err := grpc.NewClient(target, dialOpts...)
+	if err != nil {
+		slog.Error("Failed to create gRPC connection", "target", target, "error", err)
+		return nil, fmt.Errorf("failed to create gRPC connection: %v", err)
+	}
+	slog.Debug("gRPC client connection established", "target", target)
+	return conn, nil
+}
+
+// newOTLPGaugeWriter registers the canaried gauge on the meter provider
+func newOTLPGaugeWriter(protocol string, meterProvider *sdkmetric.MeterProvider, cleanup func()) (*otlpWriter, error) {
+	canaryMeter := meterProvider.Meter("o11y-canary-exported-data")
+
+	canaryGauge, err := canaryMeter.Float64Gauge(
+		canariedMetricName,
+		metric.WithDescription("o11y canary test metric for canarying"),
+	)
+
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to create metric for write: %v", err)
+	}
+
+	return &otlpWriter{protocol: protocol, meterProvider: meterProvider, gauge: canaryGauge, cleanup: cleanup}, nil
+}
+
+// WriteSample records the gauge and force flushes the meter provider so the sample leaves immediately
+// The SDK stamps the data point at collection time, just after ts, which the timestamp tolerance absorbs
+// A failed or partially rejected export fails the write, the flush is the only export of the sample the canary waits for
+func (w *otlpWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	w.gauge.Record(ctx, value, metric.WithAttributes(labels...))
+	if err := w.meterProvider.ForceFlush(ctx); err != nil {
+		return fmt.Errorf("OTLP metrics export failed: %w", err)
+	}
+	return nil
+}
+
+// Protocol returns the OTLP transport, grpc, http/protobuf or http/json
+func (w *otlpWriter) Protocol() string {
+	return w.protocol
+}
+
+// Close shuts down the meter provider and any grpc connection
+func (w *otlpWriter) Close() {
+	w.cleanup()
+}
+
+// queryPrometheus looks up the canaried metric through the Prometheus query API and verifies the written sample
+func (c *Canary) queryPrometheus(ctx context.Context, target string, ingestTarget string, requestID string, written WriteResult, tlsConfig *config.TLSConfig, auth config.Auth) (QueryResult, error) {
+	slog.Debug("Querying metric", "target", target, "ingest", ingestTarget, "canary_request_id", requestID)
+
+	roundTripper, err := endpointTransport(target, tlsConfig)
+	if err != nil {
+		return QueryResult{}, err
+	}
+	recorder := &statusRecorder{next: newAuthRoundTripper(auth, roundTripper)}
+	clientConfig := api.Config{Address: target, RoundTripper: recorder}
+
+	client, err := api.NewClient(clientConfig)
+	if err != nil {
+		return QueryResult{}, err
+	}
+
+	api := v1.NewAPI(client)
+
+	// a range selector returns the raw samples with their own timestamps rather than the evaluation time
+	window := time.Since(written.Timestamp) + c.TimestampTolerance + time.Minute
+	matchers := fmt.Sprintf(`canary="true", canary_request_id=%q, target=%q`, requestID, ingestTarget)
+	if c.Tenant != "" {
+		matchers += fmt.Sprintf(`, tenant=%q`, c.Tenant)
+	}
+	for _, kv := range AdditionalAttributes(c.AdditionalLabels) {
+		matchers += fmt.Sprintf(`, %s=%q`, kv.Key, kv.Value.AsString())
+	}
+	query := fmt.Sprintf(`%s{%s}[%ds]`, canariedMetricName, matchers, int(window.Seconds()))
+
+	result, warnings, err := api.Query(ctx, query, time.Now())
+	if err != nil {
+		if resp := recorder.last; resp != nil && resp.StatusCode/100 != 2 {
+			return QueryResult{}, newHTTPStatusError("query", resp, []byte(err.Error()))
+		}
+		return QueryResult{}, err
+	}
+	if len(warnings) > 0 {
+		slog.Info("Warning when querying target", "target", target, "canary_request_id", requestID, "warnings", warnings)
+	}
+
+	var samples []model.SamplePair
+	if matrix, ok := result.(model.Matrix); ok {
+		for _, series := range matrix {
+			samples = append(samples, series.Values...)
+		}
+	}
+	if len(samples) == 0 {
+		slog.Warn("Metric not found in query result", "target", target, "canary_request_id", requestID)
+		return QueryResult{}, fmt.Errorf("metric not found in query result for target %s with request ID %s: %w", target, requestID, ErrNotVisible)
+	}
+
+	matched, err := verifySamples(samples, written, c.ValueTolerance, c.TimestampTolerance)
+	if err != nil {
+		slog.Warn("Queried sample does not match written sample", "target", target, "canary_request_id", requestID, "error", err)
+		return QueryResult{}, err
+	}
+	slog.Debug("Query successful", "target", target, "canary_request_id", requestID, "value", written.Value)
+
+	return QueryResult{Value: float64(matched.Value), Timestamp: matched.Timestamp.Time()}, nil
+}
+
+// statusRecorder keeps the last response of a Prometheus API client, whose errors do not carry the HTTP status
+// needed to classify and retry them
+type statusRecorder struct {
+	next http.RoundTripper
+	last *http.Response
+}
+
+func (r *statusRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := r.next.RoundTrip(req)
+	if err == nil {
+		r.last = resp
+	}
+	return resp, err
+}
@@ -0,0 +1,106 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// fakePrometheus accepts remote writes and answers range selectors matching the written labels other than protocol
+type fakePrometheus struct {
+	t       *testing.T
+	mu      sync.Mutex
+	labels  map[string]string
+	value   float64
+	tsMs    int64
+	queries []string
+}
+
+func (f *fakePrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/api/v1/write":
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.labels, f.value, f.tsMs = decodeWriteRequest(f.t, body)
+		w.WriteHeader(http.StatusNoContent)
+	case "/api/v1/query":
+		r.ParseForm()
+		query := r.Form.Get("query")
+		f.queries = append(f.queries, query)
+		w.Header().Set("Content-Type", "application/json")
+		if f.labels == nil {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+			return
+		}
+		for k, v := range f.labels {
+			if k != "__name__" && k != "protocol" && !strings.Contains(query, fmt.Sprintf("%s=%q", k, v)) {
+				fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+				return
+			}
+		}
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{},"values":[[%.3f,"%v"]]}]}}`,
+			float64(f.tsMs)/1000, f.value)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestMetricsAdditionalLabels(t *testing.T) {
+	prom := &fakePrometheus{t: t}
+	srv := httptest.NewServer(prom)
+	defer srv.Close()
+
+	c := Canary{Name: "metrics_canary", Type: config.TypeMetrics, TimestampTolerance: 5 * time.Second, AdditionalLabels: map[string]string{
+		"environment": "staging",
+		"region":      "us-east",
+		"canary":      "overridden",
+	}}
+	ingest := config.Endpoint{URL: srv.URL + "/api/v1/write", Protocol: config.ProtocolRemoteWrite}
+	w, err := c.InitClient(context.Background(), nil, ingest, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), w, ingest.URL, "abc", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	prom.mu.Lock()
+	labels := prom.labels
+	prom.mu.Unlock()
+	if labels["environment"] != "staging" || labels["region"] != "us-east" {
+		t.Errorf("Expected additional labels on the written series, got %v", labels)
+	}
+	if labels["canary"] != "true" {
+		t.Errorf("Expected reserved canary label to win over additional labels, got %q", labels["canary"])
+	}
+
+	wg.Add(1)
+	if err := c.Query(context.Background(), config.Endpoint{URL: srv.URL, Protocol: config.ProtocolPrometheus}, ingest.URL, "abc", written, time.Second, nil, &wg); err != nil {
+		t.Errorf("Expected written sample to be found, got %v", err)
+	}
+	prom.mu.Lock()
+	defer prom.mu.Unlock()
+	if len(prom.queries) != 1 || !strings.Contains(prom.queries[0], `environment="staging", region="us-east"`) {
+		t.Errorf("Expected additional labels in the selector, got %v", prom.queries)
+	}
+}
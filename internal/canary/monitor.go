@@ -0,0 +1,131 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"o11y-canary/internal/config"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// ErrNotVisible is wrapped by Query errors when the canaried data has not shown up at the query endpoint yet
+var ErrNotVisible = errors.New("canaried data not visible")
+
+// ErrNotWritten is wrapped by Query errors when there is no data to look for because its write did not succeed
+var ErrNotWritten = errors.New("canaried data not written")
+
+// TimeoutError is returned when a write or query, including its polling, does not finish within its timeout
+type TimeoutError struct {
+	// Operation is write or query
+	Operation string
+	Timeout   time.Duration
+	// Err is the last error seen before giving up, if any
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s operation timed out after %s: %v", e.Operation, e.Timeout, e.Err)
+	}
+	return fmt.Sprintf("%s operation timed out after %s", e.Operation, e.Timeout)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Monitor is a check type, writing canaried data of one signal and finding it again through query endpoints
+// Implementations are registered with RegisterMonitor under the CanaryConfig.Type they handle
+type Monitor interface {
+	// NewWriter provides a Writer sending the monitor's signal to the ingest endpoint
+	NewWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error)
+	// Write sends the canaried data for the check through writer
+	Write(ctx context.Context, writer Writer, check Check) (WriteResult, error)
+	// Query looks up the data written for the check through the query endpoint
+	// It returns an error wrapping ErrNotVisible while the data is missing and a *MismatchError when it differs
+	Query(ctx context.Context, endpoint config.Endpoint, check Check, tlsConfig *config.TLSConfig) (QueryResult, error)
+}
+
+// Check identifies a single write and the queries looking for it
+type Check struct {
+	// IngestTarget is the URL of the ingest endpoint the data was written through
+	IngestTarget string
+	// RequestID is the canary_request_id of the series
+	RequestID string
+	// Written is what the write of the check sent, queries look for exactly this data even when the series was
+	// written again since. It is zero when writing
+	Written WriteResult
+	// Timeout bounds the current write or query
+	Timeout time.Duration
+}
+
+// WriteResult describes the canaried data sent by Monitor.Write
+type WriteResult struct {
+	Value     float64
+	Timestamp time.Time
+	// TraceID is the hex ID of the trace the data was exported in, set by traces monitors only
+	TraceID string
+}
+
+// QueryResult describes the canaried data found by Monitor.Query
+// Value and Timestamp are left zero by monitors whose backend only confirms the data exists
+type QueryResult struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// MonitorFactory builds the Monitor of a canary, the canary holds shared state like the tolerances
+type MonitorFactory func(c *Canary) Monitor
+
+var (
+	monitorsMu sync.RWMutex
+	monitors   = map[string]MonitorFactory{}
+)
+
+// RegisterMonitor makes a check type available under name, it panics if name is registered twice
+func RegisterMonitor(name string, factory MonitorFactory) {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	if factory == nil {
+		panic("canary: RegisterMonitor factory is nil")
+	}
+	if _, dup := monitors[name]; dup {
+		panic("canary: RegisterMonitor called twice for type " + name)
+	}
+	monitors[name] = factory
+}
+
+// MonitorTypes returns the sorted names of the registered check types
+func MonitorTypes() []string {
+	monitorsMu.RLock()
+	defer monitorsMu.RUnlock()
+	types := make([]string, 0, len(monitors))
+	for name := range monitors {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// monitor returns the Monitor registered for the canary type, built once per canary
+func (c *Canary) monitor() (Monitor, error) {
+	c.monitorOnce.Do(func() {
+		typ := c.Type
+		if typ == "" {
+			typ = config.TypeMetrics
+		}
+		monitorsMu.RLock()
+		factory, ok := monitors[typ]
+		monitorsMu.RUnlock()
+		if !ok {
+			c.monitorErr = fmt.Errorf("unknown canary type %q, registered types are %v", typ, MonitorTypes())
+			return
+		}
+		c.mon = factory(c)
+	})
+	return c.mon, c.monitorErr
+}
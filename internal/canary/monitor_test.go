@@ -0,0 +1,95 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"o11y-canary/internal/config"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+// memoryWriter keeps written values in memory
+type memoryWriter struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (w *memoryWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, kv := range labels {
+		if kv.Key == "canary_request_id" {
+			w.values[kv.Value.AsString()] = value
+		}
+	}
+	return nil
+}
+
+func (w *memoryWriter) Protocol() string { return "memory" }
+func (w *memoryWriter) Close()           {}
+
+// memoryMonitor is a check type living outside the built-in ones
+type memoryMonitor struct {
+	c *Canary
+	w *memoryWriter
+}
+
+func (m *memoryMonitor) NewWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	return m.w, nil
+}
+
+func (m *memoryMonitor) Write(ctx context.Context, writer Writer, check Check) (WriteResult, error) {
+	return m.c.writeSample(ctx, writer, check)
+}
+
+func (m *memoryMonitor) Query(ctx context.Context, endpoint config.Endpoint, check Check, tlsConfig *config.TLSConfig) (QueryResult, error) {
+	m.w.mu.Lock()
+	defer m.w.mu.Unlock()
+	v, ok := m.w.values[check.RequestID]
+	if !ok {
+		return QueryResult{}, ErrNotVisible
+	}
+	return QueryResult{Value: v}, nil
+}
+
+func TestRegisterMonitor(t *testing.T) {
+	w := &memoryWriter{values: map[string]float64{}}
+	RegisterMonitor("memory", func(c *Canary) Monitor { return &memoryMonitor{c: c, w: w} })
+
+	for _, typ := range []string{config.TypeMetrics, config.TypeLogs, config.TypeTraces, "memory"} {
+		if !slices.Contains(MonitorTypes(), typ) {
+			t.Errorf("Expected %s to be registered, got %v", typ, MonitorTypes())
+		}
+	}
+
+	c := Canary{Name: "memory_canary", Type: "memory"}
+	writer, err := c.InitClient(context.Background(), nil, config.Endpoint{}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	if err := c.Query(context.Background(), config.Endpoint{}, "mem", "abc", WriteResult{}, time.Second, nil, &wg); !errors.Is(err, ErrNotWritten) {
+		t.Errorf("Expected ErrNotWritten before writing, got %v", err)
+	}
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), writer, "mem", "abc", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wg.Add(1)
+	if err := c.Query(context.Background(), config.Endpoint{}, "mem", "abc", written, time.Second, nil, &wg); err != nil {
+		t.Errorf("Expected written value to be found, got %v", err)
+	}
+
+	unknown := Canary{Type: "unknown"}
+	if _, err := unknown.InitClient(context.Background(), nil, config.Endpoint{}, time.Second, time.Second, nil); err == nil {
+		t.Errorf("Expected error for unregistered canary type")
+	}
+}
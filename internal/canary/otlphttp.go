@@ -0,0 +1,208 @@
+package canary
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"strings"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// otlpHTTPClient sends OTLP export requests over HTTP, encoded as protobuf or JSON
+type otlpHTTPClient struct {
+	baseURL     *url.URL
+	json        bool
+	compression string
+	client      *http.Client
+}
+
+func newOTLPHTTPClient(target string, protocol string, compression string, timeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) (*otlpHTTPClient, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse OTLP HTTP endpoint %q: %w", target, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP HTTP endpoint %q must start with http:// or https://", target)
+	}
+
+	client, err := newHTTPClient(target, timeout, tlsConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Setting up OTLP HTTP client", "target", target, "protocol", protocol, "compression", compression, "tls_enabled", tlsConfig != nil && tlsConfig.Enabled)
+
+	return &otlpHTTPClient{
+		baseURL:     u,
+		json:        protocol == config.ProtocolHTTPJSON,
+		compression: compression,
+		client:      client,
+	}, nil
+}
+
+// signalURL returns the endpoint URL for a signal, appending the default /v1/<signal> path when the configured URL has none
+func (c *otlpHTTPClient) signalURL(signal string) string {
+	u := *c.baseURL
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/" + signal
+	}
+	return u.String()
+}
+
+// export posts msg to the signal path and decodes the response body into resp, failing when it rejects data
+func (c *otlpHTTPClient) export(ctx context.Context, signal string, msg proto.Message, resp proto.Message) error {
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if c.json {
+		contentType = "application/json"
+		body, err = marshalOTLPJSON(msg)
+	} else {
+		body, err = proto.Marshal(msg)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal OTLP %s request: %w", signal, err)
+	}
+
+	if c.compression == config.CompressionGzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return fmt.Errorf("failed to gzip OTLP %s request: %w", signal, err)
+		}
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to gzip OTLP %s request: %w", signal, err)
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.signalURL(signal), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP %s request: %w", signal, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "o11y-canary")
+	if c.compression == config.CompressionGzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	httpResp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("OTLP %s request failed: %w", signal, err)
+	}
+	defer httpResp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read OTLP %s response: %w", signal, err)
+	}
+	if httpResp.StatusCode/100 != 2 {
+		return newHTTPStatusError("OTLP "+signal+" export", httpResp, respBody)
+	}
+
+	if resp == nil || len(respBody) == 0 {
+		return nil
+	}
+	if strings.HasPrefix(httpResp.Header.Get("Content-Type"), "application/json") {
+		err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(respBody, resp)
+	} else {
+		err = proto.Unmarshal(respBody, resp)
+	}
+	if err != nil {
+		slog.Debug("Failed to decode OTLP response body", "signal", signal, "error", err)
+		return nil
+	}
+	return partialSuccess(resp)
+}
+
+// marshalOTLPJSON encodes msg following the OTLP/JSON rules, which differ from plain protojson:
+// enums are integers and trace/span IDs are hex rather than base64
+func marshalOTLPJSON(msg proto.Message) ([]byte, error) {
+	body, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Contains(body, []byte(`Id"`)) {
+		return body, nil
+	}
+
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	hexIDs(doc)
+	return json.Marshal(doc)
+}
+
+// hexIDs rewrites base64 encoded traceId, spanId and parentSpanId fields as hex in place
+func hexIDs(v any) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, val := range t {
+			if s, ok := val.(string); ok && (k == "traceId" || k == "spanId" || k == "parentSpanId") {
+				if raw, err := base64.StdEncoding.DecodeString(s); err == nil {
+					t[k] = hex.EncodeToString(raw)
+				}
+				continue
+			}
+			hexIDs(val)
+		}
+	case []any:
+		for _, val := range t {
+			hexIDs(val)
+		}
+	}
+}
+
+// otlpHTTPExporter is a sdkmetric.Exporter sending metrics with otlpHTTPClient
+// otlpmetrichttp only speaks protobuf and owns its http.Client, this covers both encodings with a client we control
+type otlpHTTPExporter struct {
+	client *otlpHTTPClient
+}
+
+var _ sdkmetric.Exporter = (*otlpHTTPExporter)(nil)
+
+// Temporality uses the SDK default (cumulative)
+func (e *otlpHTTPExporter) Temporality(k sdkmetric.InstrumentKind) metricdata.Temporality {
+	return sdkmetric.DefaultTemporalitySelector(k)
+}
+
+// Aggregation uses the SDK default aggregations
+func (e *otlpHTTPExporter) Aggregation(k sdkmetric.InstrumentKind) sdkmetric.Aggregation {
+	return sdkmetric.DefaultAggregationSelector(k)
+}
+
+// Export converts the collected metrics and posts them to /v1/metrics
+func (e *otlpHTTPExporter) Export(ctx context.Context, rm *metricdata.ResourceMetrics) error {
+	req := &colmetricpb.ExportMetricsServiceRequest{
+		ResourceMetrics: resourceMetricsToProto(rm),
+	}
+	return e.client.export(ctx, "metrics", req, &colmetricpb.ExportMetricsServiceResponse{})
+}
+
+// ForceFlush is a no-op, every Export is sent synchronously
+func (e *otlpHTTPExporter) ForceFlush(context.Context) error {
+	return nil
+}
+
+// Shutdown releases idle connections
+func (e *otlpHTTPExporter) Shutdown(context.Context) error {
+	e.client.client.CloseIdleConnections()
+	return nil
+}
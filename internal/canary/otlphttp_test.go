@@ -0,0 +1,100 @@
+package canary
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOTLPHTTPWriter(t *testing.T) {
+	tests := []struct {
+		protocol    string
+		compression string
+		contentType string
+	}{
+		{config.ProtocolHTTPProtobuf, config.CompressionNone, "application/x-protobuf"},
+		{config.ProtocolHTTPProtobuf, config.CompressionGzip, "application/x-protobuf"},
+		{config.ProtocolHTTPJSON, config.CompressionNone, "application/json"},
+		{config.ProtocolHTTPJSON, config.CompressionGzip, "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol+"/"+tt.compression, func(t *testing.T) {
+			received := make(chan *colmetricpb.ExportMetricsServiceRequest, 10)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/metrics" {
+					t.Errorf("Expected path /v1/metrics, got %s", r.URL.Path)
+				}
+				if got := r.Header.Get("Content-Type"); got != tt.contentType {
+					t.Errorf("Expected Content-Type %s, got %s", tt.contentType, got)
+				}
+				var body io.Reader = r.Body
+				if tt.compression == config.CompressionGzip {
+					if r.Header.Get("Content-Encoding") != "gzip" {
+						t.Errorf("Expected gzip Content-Encoding")
+					}
+					gz, err := gzip.NewReader(r.Body)
+					if err != nil {
+						t.Errorf("Failed to open gzip body: %v", err)
+						return
+					}
+					body = gz
+				}
+				b, _ := io.ReadAll(body)
+				req := &colmetricpb.ExportMetricsServiceRequest{}
+				var err error
+				if tt.protocol == config.ProtocolHTTPJSON {
+					err = protojson.Unmarshal(b, req)
+				} else {
+					err = proto.Unmarshal(b, req)
+				}
+				if err != nil {
+					t.Errorf("Failed to decode request: %v", err)
+				}
+				received <- req
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer srv.Close()
+
+			endpoint := config.Endpoint{URL: srv.URL, Protocol: tt.protocol, Compression: tt.compression}
+			var c Canary
+			w, err := c.InitClient(context.Background(), nil, endpoint, time.Second, time.Second, nil)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			defer w.Close()
+
+			if w.Protocol() != tt.protocol {
+				t.Errorf("Expected protocol %s, got %s", tt.protocol, w.Protocol())
+			}
+
+			err = w.WriteSample(context.Background(), []attribute.KeyValue{attribute.String("canary_request_id", "abc")}, 7, time.Now())
+			if err != nil {
+				t.Fatalf("WriteSample failed: %v", err)
+			}
+
+			select {
+			case req := <-received:
+				dp := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics()[0].GetGauge().GetDataPoints()[0]
+				if dp.GetAsDouble() != 7 {
+					t.Errorf("Expected value 7, got %v", dp.GetAsDouble())
+				}
+				if dp.GetAttributes()[0].GetValue().GetStringValue() != "abc" {
+					t.Errorf("Expected canary_request_id abc, got %v", dp.GetAttributes())
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("No export received")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// PartialSuccessError is returned by OTLP writes the endpoint only accepted in part, i.e. it rejected canaried data
+type PartialSuccessError struct {
+	// Signal is metrics, logs or traces
+	Signal string
+	// Rejected is the number of data points, log records or spans the endpoint rejected
+	Rejected int64
+	// Message is the reason the endpoint gave, if any
+	Message string
+}
+
+func (e *PartialSuccessError) Error() string {
+	return fmt.Sprintf("OTLP %s export partially succeeded, %d rejected: %s", e.Signal, e.Rejected, e.Message)
+}
+
+// partialSuccess returns a *PartialSuccessError when resp, an OTLP export response, reports rejected data
+// A partial success rejecting nothing only carries a warning, which is logged
+func partialSuccess(resp any) error {
+	var signal, message string
+	var rejected int64
+	switch r := resp.(type) {
+	case *colmetricpb.ExportMetricsServiceResponse:
+		signal, rejected, message = "metrics", r.GetPartialSuccess().GetRejectedDataPoints(), r.GetPartialSuccess().GetErrorMessage()
+	case *collogspb.ExportLogsServiceResponse:
+		signal, rejected, message = "logs", r.GetPartialSuccess().GetRejectedLogRecords(), r.GetPartialSuccess().GetErrorMessage()
+	case *coltracepb.ExportTraceServiceResponse:
+		signal, rejected, message = "traces", r.GetPartialSuccess().GetRejectedSpans(), r.GetPartialSuccess().GetErrorMessage()
+	default:
+		return nil
+	}
+	if rejected == 0 {
+		if message != "" {
+			slog.Warn("OTLP export succeeded with a warning", "signal", signal, "message", message)
+		}
+		return nil
+	}
+	return &PartialSuccessError{Signal: signal, Rejected: rejected, Message: message}
+}
+
+// partialSuccessInterceptor fails OTLP gRPC exports whose response rejects data, which the OTLP SDK exporters only
+// hand to the global error handler while reporting the export as successful
+func partialSuccessInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+		return err
+	}
+	return partialSuccess(reply)
+}
@@ -0,0 +1,94 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"sync"
+	"testing"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPartialSuccess(t *testing.T) {
+	var mu sync.Mutex
+	rejected := int64(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		resp := &colmetricpb.ExportMetricsServiceResponse{}
+		if rejected > 0 {
+			resp.PartialSuccess = &colmetricpb.ExportMetricsPartialSuccess{RejectedDataPoints: rejected, ErrorMessage: "out of order sample"}
+		}
+		b, _ := proto.Marshal(resp)
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.Write(b)
+	}))
+	defer srv.Close()
+
+	c := Canary{Name: "partial_canary", Type: config.TypeMetrics}
+	ingest := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolHTTPProtobuf}
+	w, err := c.InitClient(context.Background(), nil, ingest, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), w, ingest.URL, "abc", time.Second, &wg)
+	var partial *PartialSuccessError
+	if !errors.As(err, &partial) || partial.Rejected != 1 || partial.Signal != "metrics" {
+		t.Fatalf("Expected the rejected data point to fail the write, got %v", err)
+	}
+	if reason := Classify("write", err); reason != ReasonWriteFailed {
+		t.Errorf("Expected reason %s, got %s", ReasonWriteFailed, reason)
+	}
+
+	// the query endpoint is never reached, the failed write already explains the missing data
+	query := config.Endpoint{URL: "http://127.0.0.1:1", Protocol: config.ProtocolPrometheus}
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, ingest.URL, "abc", written, time.Second, nil, &wg); !errors.Is(err, ErrNotWritten) {
+		t.Errorf("Expected ErrNotWritten after the failed write, got %v", err)
+	}
+
+	mu.Lock()
+	rejected = 0
+	mu.Unlock()
+	wg.Add(1)
+	written, _, err = c.Write(context.Background(), w, ingest.URL, "abc", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, ingest.URL, "abc", written, time.Second, nil, &wg); errors.Is(err, ErrNotWritten) {
+		t.Errorf("Expected the data of a successful write to be queried, got %v", err)
+	}
+}
+
+func TestPartialSuccessInterceptor(t *testing.T) {
+	invoke := func(partial *coltracepb.ExportTracePartialSuccess) error {
+		reply := &coltracepb.ExportTraceServiceResponse{}
+		return partialSuccessInterceptor(context.Background(), "/export", nil, reply, nil, func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			reply.(*coltracepb.ExportTraceServiceResponse).PartialSuccess = partial
+			return nil
+		})
+	}
+
+	var partialErr *PartialSuccessError
+	if err := invoke(&coltracepb.ExportTracePartialSuccess{RejectedSpans: 2, ErrorMessage: "span too large"}); !errors.As(err, &partialErr) || partialErr.Rejected != 2 {
+		t.Errorf("Expected 2 rejected spans to fail the export, got %v", err)
+	}
+	if err := invoke(&coltracepb.ExportTracePartialSuccess{ErrorMessage: "deprecated attribute"}); err != nil {
+		t.Errorf("Expected a warning without rejected spans to succeed, got %v", err)
+	}
+	if err := invoke(nil); err != nil {
+		t.Errorf("Expected a full success, got %v", err)
+	}
+}
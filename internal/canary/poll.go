@@ -0,0 +1,106 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"o11y-canary/internal/config"
+	"time"
+)
+
+// PollConfig controls how PollQuery repeats a query until the canaried data is visible
+type PollConfig struct {
+	// InitialDelay is waited after the write before the first attempt
+	InitialDelay time.Duration
+	// Interval is the wait between the first and second attempt
+	Interval time.Duration
+	// Backoff multiplies the wait after every failed attempt, 1 keeps it constant
+	Backoff float64
+	// MaxInterval caps the wait between attempts
+	MaxInterval time.Duration
+	// Deadline is the total time allowed from the write until the data must be visible
+	Deadline time.Duration
+}
+
+// PollResult describes the outcome of PollQuery
+type PollResult struct {
+	// VisibleAt is when the first successful attempt was issued, the lag is VisibleAt minus the write time
+	VisibleAt time.Time
+	// Attempts is the number of queries issued
+	Attempts int
+	// Duration is how long the last attempt took
+	Duration time.Duration
+	// Retries is the number of transient failures retried within the attempts, per the canary's QueryRetry
+	Retries int
+}
+
+// PollQuery queries endpoint until the data written is found or the deadline, counted from its write, passes
+// Only data that is not visible yet is polled again, any other error (a mismatch, an auth or client error, a failure
+// left after QueryRetry) is returned as is. Running out of time is reported as a *TimeoutError wrapping the last error
+// Each attempt is bounded by the time left until the deadline
+func (c *Canary) PollQuery(ctx context.Context, endpoint config.Endpoint, ingestTarget string, requestID string, written WriteResult, poll PollConfig, tlsConfig *config.TLSConfig) (PollResult, error) {
+	var result PollResult
+	if written.Timestamp.IsZero() {
+		return result, fmt.Errorf("nothing written through %s for request ID %s: %w", ingestTarget, requestID, ErrNotWritten)
+	}
+	var lastErr error
+	deadline := written.Timestamp.Add(poll.Deadline)
+	wait := poll.Interval
+	next := written.Timestamp.Add(poll.InitialDelay)
+
+	for {
+		if !sleepUntil(ctx, next) {
+			return result, ctx.Err()
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return result, &TimeoutError{Operation: "query", Timeout: poll.Deadline, Err: lastErr}
+		}
+
+		attemptStart := time.Now()
+		retries, err := c.query(ctx, endpoint, ingestTarget, requestID, written, remaining, tlsConfig)
+		result.Retries += retries
+		result.Attempts++
+		result.Duration = time.Since(attemptStart)
+
+		lastErr = err
+		if err == nil {
+			result.VisibleAt = attemptStart
+			return result, nil
+		}
+
+		// a mismatch or a failing endpoint will not fix itself by asking again, the cause is what gets reported
+		if !errors.Is(err, ErrNotVisible) {
+			return result, err
+		}
+
+		next = time.Now().Add(wait)
+		if !next.Before(deadline) {
+			return result, &TimeoutError{Operation: "query", Timeout: poll.Deadline, Err: err}
+		}
+		slog.Debug("Canaried data not visible yet, polling again", "target", endpoint.URL, "canary_request_id", requestID, "attempt", result.Attempts, "wait", wait, "error", err)
+
+		wait = time.Duration(float64(wait) * poll.Backoff)
+		if poll.MaxInterval > 0 && wait > poll.MaxInterval {
+			wait = poll.MaxInterval
+		}
+	}
+}
+
+// sleepUntil blocks until t or until ctx is done, reporting false for the latter
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,75 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPollQuery(t *testing.T) {
+	// the trace only becomes visible after a delay, polling must keep going until then
+	visibleAfter := 200 * time.Millisecond
+	srv := newDelayedTempoServer(visibleAfter)
+	defer srv.Close()
+
+	c := Canary{Name: "traces_canary", Type: config.TypeTraces}
+	w, err := c.InitClient(context.Background(), nil, config.Endpoint{URL: srv.URL, Protocol: config.ProtocolHTTPJSON}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	poll := PollConfig{InitialDelay: 10 * time.Millisecond, Interval: 20 * time.Millisecond, Backoff: 1.5, MaxInterval: 50 * time.Millisecond, Deadline: 2 * time.Second}
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolTempo}
+
+	write := func(requestID string) WriteResult {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		written, _, err := c.Write(context.Background(), w, srv.URL, requestID, time.Second, &wg)
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		return written
+	}
+
+	written := write("abc123")
+	start := written.Timestamp
+	result, err := c.PollQuery(context.Background(), query, srv.URL, "abc123", written, poll, nil)
+	if err != nil {
+		t.Fatalf("Expected trace to become visible, got %v", err)
+	}
+	if result.Attempts < 2 {
+		t.Errorf("Expected several attempts, got %d", result.Attempts)
+	}
+	if lag := result.VisibleAt.Sub(start); lag < visibleAfter || lag > visibleAfter+poll.MaxInterval+100*time.Millisecond {
+		t.Errorf("Expected lag close to %s, got %s", visibleAfter, lag)
+	}
+
+	poll.Deadline = 100 * time.Millisecond
+	_, err = c.PollQuery(context.Background(), query, srv.URL, "late", write("late"), poll, nil)
+	var timeout *TimeoutError
+	if !errors.As(err, &timeout) || timeout.Operation != "query" {
+		t.Errorf("Expected query timeout for data that does not become visible in time, got %v", err)
+	}
+
+	// nothing was written, asking again cannot help
+	result, err = c.PollQuery(context.Background(), query, srv.URL, "missing", WriteResult{}, poll, nil)
+	if !errors.Is(err, ErrNotWritten) || result.Attempts != 0 {
+		t.Errorf("Expected ErrNotWritten without querying, got %d attempts and %v", result.Attempts, err)
+	}
+
+	unauthorized := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer unauthorized.Close()
+	poll.Deadline = 2 * time.Second
+	result, err = c.PollQuery(context.Background(), config.Endpoint{URL: unauthorized.URL, Protocol: config.ProtocolTempo}, srv.URL, "abc123", write("abc123"), poll, nil)
+	if Classify("query", err) != ReasonAuth || result.Attempts != 1 {
+		t.Errorf("Expected an auth failure after one attempt, got %d attempts and %v", result.Attempts, err)
+	}
+}
@@ -0,0 +1,153 @@
+package canary
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"o11y-canary/internal/config"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteWriter pushes the canaried metric with the Prometheus remote write 1.0 protocol
+type remoteWriteWriter struct {
+	url    string
+	job    string
+	client *http.Client
+}
+
+// prompbLabel mirrors prompb.Label, kept local to avoid importing all of prometheus/prometheus
+type prompbLabel struct {
+	Name  string
+	Value string
+}
+
+// prompbSeries is a series with a single sample, the only kind the canary writes
+type prompbSeries struct {
+	Labels      []prompbLabel
+	Value       float64
+	TimestampMs int64
+}
+
+func newRemoteWriteWriter(res *resource.Resource, target string, timeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) (*remoteWriteWriter, error) {
+	client, err := newHTTPClient(target, timeout, tlsConfig, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	// service.name becomes job, same as the collector does for OTLP
+	job := ""
+	if res != nil {
+		if v, ok := res.Set().Value(semconv.ServiceNameKey); ok {
+			job = v.AsString()
+		}
+	}
+
+	slog.Debug("Setting up remote write client", "target", target, "tls_enabled", tlsConfig != nil && tlsConfig.Enabled)
+
+	return &remoteWriteWriter{
+		url:    target,
+		job:    job,
+		client: client,
+	}, nil
+}
+
+// WriteSample sends a single sample for the canaried metric
+func (w *remoteWriteWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	promLabels := []prompbLabel{{Name: "__name__", Value: canariedMetricName}}
+	if w.job != "" {
+		promLabels = append(promLabels, prompbLabel{Name: "job", Value: w.job})
+	}
+	for _, kv := range labels {
+		promLabels = append(promLabels, prompbLabel{Name: string(kv.Key), Value: kv.Value.Emit()})
+	}
+	return w.send(ctx, []prompbSeries{{Labels: promLabels, Value: value, TimestampMs: ts.UnixMilli()}})
+}
+
+// send posts the series in one snappy compressed write request
+func (w *remoteWriteWriter) send(ctx context.Context, series []prompbSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequestSeries(series))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create remote write request: %w", err)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "o11y-canary")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("remote write request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return newHTTPStatusError("remote write", resp, msg)
+	}
+	return nil
+}
+
+// Protocol returns remote_write
+func (w *remoteWriteWriter) Protocol() string {
+	return config.ProtocolRemoteWrite
+}
+
+// Close releases idle connections
+func (w *remoteWriteWriter) Close() {
+	w.client.CloseIdleConnections()
+}
+
+// encodeWriteRequestSeries marshals a prometheus.WriteRequest holding each series with its sample
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequestSeries(all []prompbSeries) []byte {
+	var req []byte
+	for _, s := range all {
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, encodeTimeSeries(s.Labels, s.Value, s.TimestampMs))
+	}
+	return req
+}
+
+func encodeTimeSeries(labels []prompbLabel, value float64, timestampMs int64) []byte {
+	// remote write receivers expect labels sorted by name
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	var series []byte
+	for _, l := range labels {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l.Name)
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l.Value)
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(timestampMs))
+
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	return series
+}
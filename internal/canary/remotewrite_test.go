@@ -0,0 +1,130 @@
+package canary
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// decodeWriteRequest is the inverse of encodeWriteRequestSeries for a single series
+func decodeWriteRequest(t *testing.T, b []byte) (map[string]string, float64, int64) {
+	t.Helper()
+	labels := map[string]string{}
+	var value float64
+	var ts int64
+
+	num, typ, n := protowire.ConsumeTag(b)
+	if num != 1 || typ != protowire.BytesType || n < 0 {
+		t.Fatalf("expected timeseries field, got field %d type %d", num, typ)
+	}
+	series, m := protowire.ConsumeBytes(b[n:])
+	if m < 0 {
+		t.Fatalf("failed to read timeseries")
+	}
+	for len(series) > 0 {
+		num, _, n := protowire.ConsumeTag(series)
+		field, m := protowire.ConsumeBytes(series[n:])
+		series = series[n+m:]
+		switch num {
+		case 1:
+			_, _, n := protowire.ConsumeTag(field)
+			name, m := protowire.ConsumeString(field[n:])
+			field = field[n+m:]
+			_, _, n = protowire.ConsumeTag(field)
+			val, _ := protowire.ConsumeString(field[n:])
+			labels[name] = val
+		case 2:
+			_, _, n := protowire.ConsumeTag(field)
+			bits, m := protowire.ConsumeFixed64(field[n:])
+			value = math.Float64frombits(bits)
+			field = field[n+m:]
+			_, _, n = protowire.ConsumeTag(field)
+			v, _ := protowire.ConsumeVarint(field[n:])
+			ts = int64(v)
+		}
+	}
+	return labels, value, ts
+}
+
+func TestRemoteWriteWriter(t *testing.T) {
+	var gotLabels map[string]string
+	var gotValue float64
+	var gotTS int64
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("Expected snappy Content-Encoding, got %q", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("Expected remote write version header, got %q", r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Errorf("Failed to decode snappy body: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		gotLabels, gotValue, gotTS = decodeWriteRequest(t, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	w, err := newRemoteWriteWriter(nil, srv.URL+"/api/v1/write", time.Second, nil, config.Auth{})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	before := time.Now().UnixMilli()
+	err = w.WriteSample(context.Background(), []attribute.KeyValue{
+		attribute.String("canary_request_id", "abc"),
+		attribute.String("canary", "true"),
+	}, 42, time.Now())
+	if err != nil {
+		t.Fatalf("WriteSample failed: %v", err)
+	}
+
+	expected := map[string]string{
+		"__name__":          canariedMetricName,
+		"canary":            "true",
+		"canary_request_id": "abc",
+	}
+	for k, v := range expected {
+		if gotLabels[k] != v {
+			t.Errorf("Expected label %s=%q, got %q", k, v, gotLabels[k])
+		}
+	}
+	if gotValue != 42 {
+		t.Errorf("Expected value 42, got %v", gotValue)
+	}
+	if gotTS < before || gotTS > time.Now().UnixMilli() {
+		t.Errorf("Expected timestamp around %d, got %d", before, gotTS)
+	}
+}
+
+func TestRemoteWriteWriterError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	w, err := newRemoteWriteWriter(nil, srv.URL, time.Second, nil, config.Auth{})
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	if err := w.WriteSample(context.Background(), nil, 1, time.Now()); err == nil {
+		t.Errorf("Expected error for 400 response, got nil")
+	}
+}
@@ -0,0 +1,114 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/rand"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy controls how a single write or query is retried after a transient failure
+// The zero value never retries
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, 1 or less never retries
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts, a longer Retry-After is still honoured
+	MaxBackoff time.Duration
+	// Multiplier is applied to the wait after every retry
+	Multiplier float64
+	// Jitter adds or removes a random fraction of every wait, between 0 and 1
+	Jitter float64
+	// RetryableStatusCodes are the HTTP status codes retried, gRPC codes are matched by their HTTP equivalent
+	RetryableStatusCodes []int
+}
+
+// grpcHTTPStatus maps the transient gRPC codes to the HTTP status a retryable status code list would name them by
+var grpcHTTPStatus = map[codes.Code]int{
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.Internal:          http.StatusInternalServerError,
+	codes.Unavailable:       http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:  http.StatusGatewayTimeout,
+}
+
+// retryable reports whether err is transient, i.e. a retryable status code or a connection refused or reset
+func (p RetryPolicy) retryable(operation string, err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return slices.Contains(p.RetryableStatusCodes, statusErr.StatusCode)
+	}
+	if classifyTransport(err) == ReasonConnect {
+		return true
+	}
+	if st, ok := status.FromError(err); ok {
+		// connection failures of gRPC are Unavailable too, but are retried like their HTTP counterparts
+		if code, ok := grpcHTTPStatus[st.Code()]; ok {
+			return slices.Contains(p.RetryableStatusCodes, code) || Classify(operation, err) == ReasonConnect
+		}
+	}
+	return false
+}
+
+// backoff returns the wait before retry n (from 1), with jitter, honouring a Retry-After sent with err
+func (p RetryPolicy) backoff(n int, err error) time.Duration {
+	wait := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(n-1))
+	if p.MaxBackoff > 0 && wait > float64(p.MaxBackoff) {
+		wait = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		wait *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	d := time.Duration(wait)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > d {
+		d = statusErr.RetryAfter
+	}
+	return d
+}
+
+// do calls attempt until it succeeds, fails with an error that is not transient, runs out of attempts or the next
+// wait would pass deadline, and returns the last error. Every retry is counted in retries, as it happens so a caller
+// giving up on the deadline still sees them
+func (p RetryPolicy) do(ctx context.Context, operation string, deadline time.Time, retries func(), attempt func() error) error {
+	for n := 1; ; n++ {
+		err := attempt()
+		if err == nil || n >= p.MaxAttempts || !p.retryable(operation, err) {
+			return err
+		}
+		wait := p.backoff(n, err)
+		if time.Now().Add(wait).After(deadline) {
+			slog.Debug("Not retrying, the backoff would pass the deadline", "operation", operation, "wait", wait, "error", err)
+			return err
+		}
+		slog.Debug("Retrying after transient failure", "operation", operation, "attempt", n, "wait", wait, "error", err)
+		if !sleepUntil(ctx, time.Now().Add(wait)) {
+			return err
+		}
+		retries()
+	}
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date, 0 when it is missing or invalid
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
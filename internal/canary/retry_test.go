@@ -0,0 +1,113 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyHandler answers with the queued statuses, 429 with a Retry-After of one second, before passing requests on
+type flakyHandler struct {
+	mu       sync.Mutex
+	statuses []int
+	next     http.Handler
+}
+
+func (h *flakyHandler) fail(statuses ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.statuses = statuses
+}
+
+func (h *flakyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	if len(h.statuses) > 0 {
+		status := h.statuses[0]
+		h.statuses = h.statuses[1:]
+		h.mu.Unlock()
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "1")
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	h.mu.Unlock()
+	h.next.ServeHTTP(w, r)
+}
+
+func TestRetryPolicy(t *testing.T) {
+	flaky := &flakyHandler{next: &fakePrometheus{t: t}}
+	srv := httptest.NewServer(flaky)
+	defer srv.Close()
+
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2, Jitter: 0.2, RetryableStatusCodes: []int{429, 502, 503, 504}}
+	c := Canary{Name: "retry_canary", Type: config.TypeMetrics, TimestampTolerance: 5 * time.Second, WriteRetry: policy, QueryRetry: policy}
+	ingest := config.Endpoint{URL: srv.URL + "/api/v1/write", Protocol: config.ProtocolRemoteWrite}
+	w, err := c.InitClient(context.Background(), nil, ingest, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	write := func(timeout time.Duration) (WriteResult, int, error) {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		return c.Write(context.Background(), w, ingest.URL, "abc", timeout, &wg)
+	}
+
+	flaky.fail(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	start := time.Now()
+	written, retries, err := write(3 * time.Second)
+	if err != nil || retries != 2 {
+		t.Errorf("Expected the write to succeed after 2 retries, got %d retries and %v", retries, err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("Expected the Retry-After of the 429 to be honoured, retried after %s", elapsed)
+	}
+
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolPrometheus}
+	flaky.fail(http.StatusBadGateway)
+	poll := PollConfig{Interval: 10 * time.Millisecond, Backoff: 1, Deadline: 2 * time.Second}
+	if result, err := c.PollQuery(context.Background(), query, ingest.URL, "abc", written, poll, nil); err != nil || result.Retries != 1 || result.Attempts != 1 {
+		t.Errorf("Expected the query to succeed in one attempt with 1 retry, got %+v and %v", result, err)
+	}
+
+	var statusErr *httpStatusError
+	flaky.fail(http.StatusBadRequest)
+	if _, retries, err := write(time.Second); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusBadRequest || retries != 0 {
+		t.Errorf("Expected a 400 not to be retried, got %d retries and %v", retries, err)
+	}
+
+	flaky.fail(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	if _, retries, err := write(time.Second); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || retries != 2 {
+		t.Errorf("Expected the write to give up after 3 attempts, got %d retries and %v", retries, err)
+	}
+
+	// waiting as asked would pass the write timeout, so the 429 is returned right away
+	flaky.fail(http.StatusTooManyRequests)
+	start = time.Now()
+	if _, retries, err := write(500 * time.Millisecond); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusTooManyRequests || retries != 0 {
+		t.Errorf("Expected the 429 not to be retried past the timeout, got %d retries and %v", retries, err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected to give up without waiting, took %s", elapsed)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("Expected 2m from seconds, got %s", got)
+	}
+	date := time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 25*time.Second || got > 30*time.Second {
+		t.Errorf("Expected about 30s from an HTTP date, got %s", got)
+	}
+	if got := parseRetryAfter("soon"); got != 0 {
+		t.Errorf("Expected 0 for an invalid value, got %s", got)
+	}
+}
@@ -0,0 +1,198 @@
+package canary
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/rand"
+)
+
+// Series is one slot in the canaried series rotation
+type Series struct {
+	// Index is the slot of the series, between 0 and MaxActiveSeries
+	Index int
+	// RequestID is the canary_request_id label value, stable for the slot so cardinality stays bounded
+	RequestID string
+	// Query is set when the written data should also be queried back, per the query interval and sample ratio
+	Query bool
+}
+
+// CheckFunc writes a single series and, when series.Query is set, returns the query of the written data or nil
+// It is called at most once at a time per series
+type CheckFunc func(ctx context.Context, series Series) QueryFunc
+
+// QueryFunc queries back the data a check wrote, it runs apart from the checks so polling a slow query endpoint never
+// delays the writes of the series, and at most once at a time per series
+type QueryFunc func(ctx context.Context)
+
+// SchedulerConfig controls how a Scheduler spreads checks over the interval
+type SchedulerConfig struct {
+	// Interval is how often every series is checked, i.e. written
+	Interval time.Duration
+	// QueryInterval is how often the data of a series is queried back, at most once per check. Zero queries every check
+	QueryInterval time.Duration
+	// QuerySampleRatio is the fraction of the checks due for a query that actually query, between 0 and 1. Zero means 1
+	QuerySampleRatio float64
+	// MaxActiveSeries is the number of series in rotation
+	MaxActiveSeries int
+	// Jitter delays each check by a random fraction of its slot, between 0 and 1
+	Jitter float64
+	// MaxConcurrency bounds the number of checks running at once, queries are bounded by MaxActiveSeries instead
+	MaxConcurrency int
+}
+
+// Scheduler owns the series rotation of a canary and runs checks spread evenly across the interval
+type Scheduler struct {
+	cfg   SchedulerConfig
+	check CheckFunc
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	mu         sync.Mutex
+	requestIDs []string
+	inFlight   []bool
+	querying   []bool
+	lastQuery  []time.Time
+}
+
+// NewScheduler provides a scheduler calling check for every series once per interval
+func NewScheduler(cfg SchedulerConfig, check CheckFunc) (*Scheduler, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("scheduler interval must be positive, got %s", cfg.Interval)
+	}
+	if cfg.MaxActiveSeries <= 0 {
+		return nil, fmt.Errorf("scheduler needs at least one series, got %d", cfg.MaxActiveSeries)
+	}
+	if cfg.Jitter < 0 || cfg.Jitter > 1 {
+		return nil, fmt.Errorf("scheduler jitter must be between 0 and 1, got %v", cfg.Jitter)
+	}
+	if cfg.QueryInterval < 0 {
+		return nil, fmt.Errorf("scheduler query interval must not be negative, got %s", cfg.QueryInterval)
+	}
+	if cfg.QuerySampleRatio < 0 || cfg.QuerySampleRatio > 1 {
+		return nil, fmt.Errorf("scheduler query sample ratio must be between 0 and 1, got %v", cfg.QuerySampleRatio)
+	}
+	if cfg.QuerySampleRatio == 0 {
+		cfg.QuerySampleRatio = 1
+	}
+	if cfg.MaxConcurrency <= 0 {
+		cfg.MaxConcurrency = cfg.MaxActiveSeries
+	}
+	return &Scheduler{
+		cfg:        cfg,
+		check:      check,
+		sem:        make(chan struct{}, cfg.MaxConcurrency),
+		requestIDs: make([]string, cfg.MaxActiveSeries),
+		inFlight:   make([]bool, cfg.MaxActiveSeries),
+		querying:   make([]bool, cfg.MaxActiveSeries),
+		lastQuery:  make([]time.Time, cfg.MaxActiveSeries),
+	}, nil
+}
+
+// Run dispatches checks until ctx is cancelled, then waits for the running checks and queries to return
+func (s *Scheduler) Run(ctx context.Context) {
+	defer s.wg.Wait()
+
+	slot := s.cfg.Interval / time.Duration(s.cfg.MaxActiveSeries)
+	next := time.Now()
+	for tick := 0; ; tick++ {
+		at := next
+		if s.cfg.Jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(float64(slot)*s.cfg.Jitter) + 1)))
+		}
+		if !sleepUntil(ctx, at) {
+			return
+		}
+		s.dispatch(ctx, tick%s.cfg.MaxActiveSeries)
+		next = next.Add(slot)
+	}
+}
+
+// RequestIDs returns the request IDs of the series seen so far
+func (s *Scheduler) RequestIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.requestIDs))
+	for _, id := range s.requestIDs {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// dispatch starts the check for series idx unless it is still running or the concurrency limit is reached
+// A check due for a query while the previous query of the series is still polling only writes
+func (s *Scheduler) dispatch(ctx context.Context, idx int) {
+	s.mu.Lock()
+	if s.inFlight[idx] {
+		s.mu.Unlock()
+		slog.Warn("Skipping canary check, previous check of the series is still running", "series", idx)
+		return
+	}
+	select {
+	case s.sem <- struct{}{}:
+	default:
+		s.mu.Unlock()
+		slog.Warn("Skipping canary check, concurrency limit reached", "series", idx, "max_concurrency", s.cfg.MaxConcurrency)
+		return
+	}
+	if s.requestIDs[idx] == "" {
+		s.requestIDs[idx] = fmt.Sprintf("%016x", rand.Uint64())
+	}
+	series := Series{Index: idx, RequestID: s.requestIDs[idx], Query: s.queryDue(idx, time.Now())}
+	if series.Query && s.querying[idx] {
+		slog.Warn("Not querying canary check, previous query of the series is still running", "series", idx)
+		series.Query = false
+	}
+	s.inFlight[idx] = true
+	s.querying[idx] = s.querying[idx] || series.Query
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		var query QueryFunc
+		defer func() {
+			<-s.sem
+			s.mu.Lock()
+			s.inFlight[idx] = false
+			s.mu.Unlock()
+			if !series.Query {
+				s.wg.Done()
+				return
+			}
+			s.query(ctx, idx, query)
+		}()
+		query = s.check(ctx, series)
+	}()
+}
+
+// query runs the query a check of series idx returned, if any, once the check released its place so the next check of
+// the series can start while it polls. It takes over the check's place in the wait group
+func (s *Scheduler) query(ctx context.Context, idx int, query QueryFunc) {
+	defer func() {
+		s.mu.Lock()
+		s.querying[idx] = false
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+	if query != nil {
+		query(ctx)
+	}
+}
+
+// queryDue reports whether the check of series idx starting at now queries, it must be called with mu held
+// A series is due once QueryInterval passed since its last due check, half an interval early so jitter does not push
+// the query to the check after. A due check consumes the slot even when it is sampled out
+func (s *Scheduler) queryDue(idx int, now time.Time) bool {
+	if s.cfg.QueryInterval > s.cfg.Interval {
+		if !s.lastQuery[idx].IsZero() && now.Sub(s.lastQuery[idx]) < s.cfg.QueryInterval-s.cfg.Interval/2 {
+			return false
+		}
+		s.lastQuery[idx] = now
+	}
+	return s.cfg.QuerySampleRatio >= 1 || rand.Float64() < s.cfg.QuerySampleRatio
+}
@@ -0,0 +1,221 @@
+package canary
+
+import (
+	"context"
+	"o11y-canary/internal/config"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning, calls := 0, 0, 0
+	seen := map[int]map[string]bool{}
+
+	s, err := NewScheduler(SchedulerConfig{Interval: 100 * time.Millisecond, MaxActiveSeries: 5, Jitter: 0.5, MaxConcurrency: 2}, func(ctx context.Context, series Series) QueryFunc {
+		mu.Lock()
+		running++
+		calls++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		if seen[series.Index] == nil {
+			seen[series.Index] = map[string]bool{}
+		}
+		seen[series.Index][series.RequestID] = true
+		mu.Unlock()
+
+		time.Sleep(30 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if running != 0 {
+		t.Errorf("Expected Run to wait for running checks, %d still running", running)
+	}
+	if maxRunning > 2 {
+		t.Errorf("Expected at most 2 concurrent checks, got %d", maxRunning)
+	}
+	if calls < 5 {
+		t.Errorf("Expected every series to be checked at least once, got %d calls", calls)
+	}
+	if len(seen) != 5 {
+		t.Errorf("Expected 5 series in rotation, got %d", len(seen))
+	}
+	for idx, ids := range seen {
+		if len(ids) != 1 {
+			t.Errorf("Expected series %d to keep one request ID, got %v", idx, ids)
+		}
+	}
+	if got := len(s.RequestIDs()); got != 5 {
+		t.Errorf("Expected 5 request IDs, got %d", got)
+	}
+}
+
+func TestNewSchedulerInvalid(t *testing.T) {
+	for _, cfg := range []SchedulerConfig{
+		{Interval: 0, MaxActiveSeries: 1},
+		{Interval: time.Second, MaxActiveSeries: 0},
+		{Interval: time.Second, MaxActiveSeries: 1, Jitter: 2},
+		{Interval: time.Second, MaxActiveSeries: 1, QuerySampleRatio: 1.5},
+	} {
+		if _, err := NewScheduler(cfg, func(context.Context, Series) QueryFunc { return nil }); err == nil {
+			t.Errorf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestSchedulerQueryDue(t *testing.T) {
+	noop := func(context.Context, Series) QueryFunc { return nil }
+	s, err := NewScheduler(SchedulerConfig{Interval: 5 * time.Second, QueryInterval: 30 * time.Second, MaxActiveSeries: 1}, noop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	var queried []int
+	for i := 0; i < 13; i++ {
+		if s.queryDue(0, start.Add(time.Duration(i)*5*time.Second)) {
+			queried = append(queried, i)
+		}
+	}
+	if len(queried) != 3 || queried[0] != 0 || queried[1] != 6 || queried[2] != 12 {
+		t.Errorf("Expected every 6th write to be queried, got writes %v", queried)
+	}
+
+	s, err = NewScheduler(SchedulerConfig{Interval: time.Second, QuerySampleRatio: 0.25, MaxActiveSeries: 1}, noop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for i := 0; i < 4000; i++ {
+		if s.queryDue(0, start) {
+			n++
+		}
+	}
+	if n < 800 || n > 1200 {
+		t.Errorf("Expected about a quarter of 4000 writes to be queried, got %d", n)
+	}
+}
+
+func TestSchedulerSlowQuery(t *testing.T) {
+	var mu sync.Mutex
+	writes, queries, queriesRunning := 0, 0, 0
+	// every query polls for 5 write intervals, the writes of the series must keep their schedule meanwhile
+	s, err := NewScheduler(SchedulerConfig{Interval: 20 * time.Millisecond, MaxActiveSeries: 1}, func(ctx context.Context, series Series) QueryFunc {
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		if !series.Query {
+			return nil
+		}
+		return func(ctx context.Context) {
+			mu.Lock()
+			queries++
+			queriesRunning++
+			if queriesRunning > 1 {
+				t.Errorf("Expected one query of the series at a time, got %d", queriesRunning)
+			}
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			queriesRunning--
+			mu.Unlock()
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 290*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if writes < 12 {
+		t.Errorf("Expected writes every interval while queries poll, got %d", writes)
+	}
+	if queries < 2 || queries > 3 {
+		t.Errorf("Expected a new query only once the previous one returned, got %d", queries)
+	}
+	if queriesRunning != 0 {
+		t.Errorf("Expected Run to wait for running queries, %d still running", queriesRunning)
+	}
+}
+
+func TestSchedulerLagLongerThanInterval(t *testing.T) {
+	// the data becomes visible 4 write intervals after it was written, well within the query timeout, so every query
+	// must find the data of its own check although the series was written again since
+	visibleAfter := 120 * time.Millisecond
+	srv := newDelayedTempoServer(visibleAfter)
+	defer srv.Close()
+
+	c := Canary{Name: "traces_canary", Type: config.TypeTraces}
+	w, err := c.InitClient(context.Background(), nil, config.Endpoint{URL: srv.URL, Protocol: config.ProtocolHTTPJSON}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolTempo}
+	poll := PollConfig{Interval: 10 * time.Millisecond, Backoff: 1, Deadline: time.Second}
+
+	var mu sync.Mutex
+	var lags []time.Duration
+	var errs []error
+	s, err := NewScheduler(SchedulerConfig{Interval: 30 * time.Millisecond, MaxActiveSeries: 1}, func(ctx context.Context, series Series) QueryFunc {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		written, _, err := c.Write(ctx, w, srv.URL, series.RequestID, time.Second, &wg)
+		if err != nil || !series.Query {
+			return nil
+		}
+		return func(ctx context.Context) {
+			result, err := c.PollQuery(ctx, query, srv.URL, series.RequestID, written, poll, nil)
+			if ctx.Err() != nil {
+				// the run ended while polling
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+			lags = append(lags, result.VisibleAt.Sub(written.Timestamp))
+		}
+	})
+	if err != nil {
+		t.Fatalf("Failed to create scheduler: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	s.Run(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) > 0 {
+		t.Errorf("Expected every query to find the data of its check, got %v", errs)
+	}
+	if len(lags) < 2 {
+		t.Errorf("Expected several queries to succeed, got %d", len(lags))
+	}
+	for _, lag := range lags {
+		if lag < visibleAfter || lag > visibleAfter+100*time.Millisecond {
+			t.Errorf("Expected lag close to %s, got %s", visibleAfter, lag)
+		}
+	}
+}
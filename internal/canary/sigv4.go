@@ -0,0 +1,360 @@
+package canary
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	// defaultSigV4Service is the signing name of Amazon Managed Service for Prometheus
+	defaultSigV4Service = "aps"
+	// assumedRoleRefresh is how long before they expire assumed role credentials are replaced
+	assumedRoleRefresh = 5 * time.Minute
+	// assumedRoleSession names the canary's role sessions in CloudTrail
+	assumedRoleSession = "o11y-canary"
+)
+
+// awsCredentials are the keys requests are signed with, SessionToken is only set for temporary credentials
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time
+}
+
+// sigV4RoundTripper signs every request with AWS Signature Version 4
+type sigV4RoundTripper struct {
+	cfg  config.SigV4
+	next http.RoundTripper
+	// sts assumes the configured role with the default TLS settings, bounded by tokenFetchTimeout. The CA file, server
+	// name and client certificate of the endpoint are not meant for STS
+	sts *http.Client
+}
+
+func newSigV4RoundTripper(cfg config.SigV4, next http.RoundTripper) *sigV4RoundTripper {
+	return &sigV4RoundTripper{cfg: cfg, next: next, sts: &http.Client{Timeout: tokenFetchTimeout}}
+}
+
+func (rt *sigV4RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := sigV4Credentials(req.Context(), rt.sts, rt.cfg)
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	// the payload is part of the signature, so the body is read here and replaced
+	var payload []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		payload, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	// a RoundTripper must not modify the caller's request
+	req = req.Clone(req.Context())
+	if payload != nil {
+		req.Body = io.NopCloser(bytes.NewReader(payload))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(payload)), nil }
+	}
+
+	service := rt.cfg.Service
+	if service == "" {
+		service = defaultSigV4Service
+	}
+	signSigV4(req, payload, creds, rt.cfg.Region, service, time.Now())
+	return rt.next.RoundTrip(req)
+}
+
+// signSigV4 adds the X-Amz-Date, X-Amz-Security-Token and Authorization headers of an AWS Signature Version 4 signature
+// over the method, path, query, host and payload of req
+func signSigV4(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host, "x-amz-date": amzDate}
+	if creds.SessionToken != "" {
+		headers["x-amz-security-token"] = creds.SessionToken
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	date := amzDate[:8]
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", sigV4Algorithm, creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalURI encodes the escaped path once more, as every service but S3 expects
+func canonicalURI(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = uriEncode(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// canonicalQuery sorts the query parameters by name and value
+func canonicalQuery(u *url.URL) string {
+	values := u.Query()
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		vals := append([]string{}, values[name]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			params = append(params, uriEncode(name)+"="+uriEncode(v))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent-encodes everything but the RFC 3986 unreserved characters
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// sigV4Credentials returns the credentials to sign with, assuming the configured role through sts when there is one
+func sigV4Credentials(ctx context.Context, sts *http.Client, cfg config.SigV4) (awsCredentials, error) {
+	creds, err := baseCredentials(cfg)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if cfg.RoleARN == "" {
+		return creds, nil
+	}
+	return assumedRoleCredentials(ctx, sts, cfg, creds)
+}
+
+// baseCredentials are the static keys, else the AWS_* environment variables, else the shared credentials file profile
+// Environment and file are read on every call so rotated credentials are picked up without a restart
+func baseCredentials(cfg config.SigV4) (awsCredentials, error) {
+	if cfg.AccessKey != "" {
+		return awsCredentials{AccessKeyID: cfg.AccessKey, SecretAccessKey: cfg.SecretKey}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); cfg.Profile == "" && id != "" {
+		return awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	return profileCredentials(cfg.Profile)
+}
+
+// profileCredentials reads profile from the shared credentials file, AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+func profileCredentials(profile string) (awsCredentials, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("no AWS credentials: %w", err)
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials in the environment and no shared credentials file: %w", err)
+	}
+	defer f.Close()
+
+	var creds awsCredentials
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return awsCredentials{}, fmt.Errorf("failed to read shared credentials file %s: %w", path, err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, fmt.Errorf("no AWS credentials for profile %q in %s", profile, path)
+	}
+	return creds, nil
+}
+
+// assumedRoles caches the credentials of each assumed role, shared by every client with the same configuration
+var assumedRoles sync.Map
+
+type assumedRole struct {
+	mu    sync.Mutex
+	creds awsCredentials
+}
+
+// assumedRoleCredentials returns the cached credentials of cfg.RoleARN, assuming the role again with base shortly
+// before they expire
+func assumedRoleCredentials(ctx context.Context, sts *http.Client, cfg config.SigV4, base awsCredentials) (awsCredentials, error) {
+	v, _ := assumedRoles.LoadOrStore(cfg, &assumedRole{})
+	role := v.(*assumedRole)
+	role.mu.Lock()
+	defer role.mu.Unlock()
+	if time.Until(role.creds.Expires) > assumedRoleRefresh {
+		return role.creds, nil
+	}
+	creds, err := assumeRole(ctx, sts, cfg, base)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role.creds = creds
+	return creds, nil
+}
+
+// stsEndpoint is the regional STS endpoint, AWS_ENDPOINT_URL_STS overrides it like it does for the AWS SDKs
+func stsEndpoint(region string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL_STS"); endpoint != "" {
+		return endpoint
+	}
+	return "https://sts." + region + ".amazonaws.com/"
+}
+
+// assumeRoleResponse is the part of the STS AssumeRole response the canary needs
+type assumeRoleResponse struct {
+	Credentials struct {
+		AccessKeyID     string    `xml:"AccessKeyId"`
+		SecretAccessKey string    `xml:"SecretAccessKey"`
+		SessionToken    string    `xml:"SessionToken"`
+		Expiration      time.Time `xml:"Expiration"`
+	} `xml:"AssumeRoleResult>Credentials"`
+}
+
+// assumeRole calls STS AssumeRole signed with base through client, failures are returned as a *TokenError
+func assumeRole(ctx context.Context, client *http.Client, cfg config.SigV4, base awsCredentials) (awsCredentials, error) {
+	endpoint := stsEndpoint(cfg.Region)
+	body := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {cfg.RoleARN},
+		"RoleSessionName": {assumedRoleSession},
+	}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(body))
+	if err != nil {
+		return awsCredentials{}, &TokenError{TokenURL: endpoint, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signSigV4(req, []byte(body), base, cfg.Region, "sts", time.Now())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return awsCredentials{}, &TokenError{TokenURL: endpoint, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return awsCredentials{}, &TokenError{TokenURL: endpoint, Err: fmt.Errorf("assuming role %s: %s: %s", cfg.RoleARN, resp.Status, strings.TrimSpace(string(msg)))}
+	}
+
+	var out assumeRoleResponse
+	if err := xml.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return awsCredentials{}, &TokenError{TokenURL: endpoint, Err: fmt.Errorf("failed to decode AssumeRole response: %w", err)}
+	}
+	c := out.Credentials
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return awsCredentials{}, &TokenError{TokenURL: endpoint, Err: fmt.Errorf("AssumeRole response for %s has no credentials", cfg.RoleARN)}
+	}
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expires: c.Expiration}, nil
+}
@@ -0,0 +1,170 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"o11y-canary/internal/config"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+)
+
+func TestSignSigV4(t *testing.T) {
+	// get-vanilla from the AWS Signature Version 4 test suite
+	req, _ := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signSigV4(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("Unexpected signature\n got: %s\nwant: %s", got, want)
+	}
+}
+
+var authorizationRE = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/\d{8}/([^/]+)/([^/]+)/aws4_request, SignedHeaders=[^,]+, Signature=[0-9a-f]{64}$`)
+
+// verifySigV4 checks the signature of r like AWS does, knowing the secret of every access key in secrets
+func verifySigV4(r *http.Request, secrets map[string]string, service string) error {
+	m := authorizationRE.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("malformed authorization %q", r.Header.Get("Authorization"))
+	}
+	secret, ok := secrets[m[1]]
+	if !ok {
+		return fmt.Errorf("unknown access key %s", m[1])
+	}
+	if m[2] != "eu-west-1" || m[3] != service {
+		return fmt.Errorf("unexpected scope %s/%s", m[2], m[3])
+	}
+	ts, err := time.Parse(sigV4TimeFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+
+	expected := r.Clone(context.Background())
+	creds := awsCredentials{AccessKeyID: m[1], SecretAccessKey: secret, SessionToken: r.Header.Get("X-Amz-Security-Token")}
+	signSigV4(expected, body, creds, m[2], m[3], ts)
+	if expected.Header.Get("Authorization") != r.Header.Get("Authorization") {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// sigV4Stub is an endpoint that rejects requests without a valid aps signature
+func sigV4Stub(t *testing.T, secrets map[string]string, requests *atomic.Int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifySigV4(r, secrets, defaultSigV4Service); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		requests.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSigV4RoundTripper(t *testing.T) {
+	var requests atomic.Int32
+	srv := sigV4Stub(t, map[string]string{"AKIDSTATIC": "static-secret", "AKIDENV": "env-secret", "AKIDPROFILE": "profile-secret"}, &requests)
+
+	// remote write signs the snappy payload
+	static := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1", AccessKey: "AKIDSTATIC", SecretKey: "static-secret"}}
+	w, err := newRemoteWriteWriter(resource.Empty(), srv.URL+"/workspaces/ws-1/api/v1/remote_write", time.Second, nil, static)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.WriteSample(context.Background(), []attribute.KeyValue{attribute.String("target", "amp")}, 1, time.Now()); err != nil {
+		t.Errorf("Signed remote write failed: %v", err)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "env-session")
+	env := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1"}}
+	params := url.Values{"query": {`o11y_canary_canaried_metric_total{canary="true"}`}}
+	if _, err := httpGet(context.Background(), srv.URL, "/workspaces/ws-1/api/v1/query", params, time.Second, nil, env); err != nil {
+		t.Errorf("Signed query with environment credentials failed: %v", err)
+	}
+
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	content := "[default]\naws_access_key_id = AKIDENV\naws_secret_access_key = wrong\n\n[canary]\naws_access_key_id = AKIDPROFILE\naws_secret_access_key = profile-secret\n"
+	if err := os.WriteFile(credentialsFile, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	profile := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1", Profile: "canary"}}
+	if _, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, profile); err != nil {
+		t.Errorf("Signed query with profile credentials failed: %v", err)
+	}
+
+	if n := requests.Load(); n != 3 {
+		t.Errorf("Expected 3 verified requests, got %d", n)
+	}
+
+	wrong := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1", AccessKey: "AKIDSTATIC", SecretKey: "wrong"}}
+	var statusErr *httpStatusError
+	if _, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, nil, wrong); !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the stub to reject a wrong secret, got %v", err)
+	}
+}
+
+func TestSigV4AssumeRole(t *testing.T) {
+	var assumed atomic.Int32
+	// the endpoint trusts another CA than STS does, the role must be assumed with the default TLS settings
+	sts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifySigV4(r, map[string]string{"AKIDBASE": "base-secret"}, "sts"); err != nil {
+			http.Error(w, "<ErrorResponse><Error><Code>SignatureDoesNotMatch</Code></Error></ErrorResponse>", http.StatusForbidden)
+			return
+		}
+		assumed.Add(1)
+		fmt.Fprintf(w, `<AssumeRoleResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/"><AssumeRoleResult><Credentials>`+
+			`<AccessKeyId>ASIATEMP</AccessKeyId><SecretAccessKey>temp-secret</SecretAccessKey><SessionToken>temp-session</SessionToken>`+
+			`<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer sts.Close()
+	t.Setenv("AWS_ENDPOINT_URL_STS", sts.URL)
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = sts.Client().Transport
+	defer func() { http.DefaultTransport = defaultTransport }()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, newTestCA(t, "endpoint-ca").pem, 0)
+	tlsConfig := &config.TLSConfig{Enabled: true, CAFile: caFile, ServerName: "endpoint.internal"}
+
+	var requests atomic.Int32
+	srv := sigV4Stub(t, map[string]string{"ASIATEMP": "temp-secret"}, &requests)
+
+	auth := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1", AccessKey: "AKIDBASE", SecretKey: "base-secret", RoleARN: "arn:aws:iam::123456789012:role/canary"}}
+	for i := 0; i < 2; i++ {
+		if _, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, tlsConfig, auth); err != nil {
+			t.Fatalf("Request with assumed role failed: %v", err)
+		}
+	}
+	if n := assumed.Load(); n != 1 {
+		t.Errorf("Expected the role to be assumed once and cached, got %d", n)
+	}
+
+	denied := config.Auth{SigV4: &config.SigV4{Region: "eu-west-1", AccessKey: "AKIDBASE", SecretKey: "wrong", RoleARN: "arn:aws:iam::123456789012:role/denied"}}
+	_, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, tlsConfig, denied)
+	var tokenErr *TokenError
+	if !errors.As(err, &tokenErr) || tokenErr.TokenURL != sts.URL {
+		t.Errorf("Expected a TokenError when the role cannot be assumed, got %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"o11y-canary/internal/config"
+	"sync"
+	"time"
+)
+
+// IsolationError is returned by CheckIsolation when data written for one tenant is visible to another
+type IsolationError struct {
+	// Tenant the data was written for
+	Tenant string
+	// QueryTenant is the tenant the data was visible to
+	QueryTenant string
+	RequestID   string
+}
+
+func (e *IsolationError) Error() string {
+	return fmt.Sprintf("tenant isolation violated: data written for tenant %q with request ID %s is visible to tenant %q", e.Tenant, e.RequestID, e.QueryTenant)
+}
+
+// CheckIsolation queries endpoint once as queryTenant for the data written, which this canary wrote through
+// ingestTarget
+// It returns nil when the data is not visible, an *IsolationError when it is, and any other error when the query
+// could not tell, e.g. because the endpoint refused the tenant's credentials
+// Call it after the data was found as the canary's own tenant, otherwise not seeing it proves nothing
+func (c *Canary) CheckIsolation(ctx context.Context, endpoint config.Endpoint, queryTenant config.Tenant, ingestTarget string, requestID string, written WriteResult, timeout time.Duration, tlsConfig *config.TLSConfig) error {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	err := c.Query(ctx, queryTenant.Endpoint(endpoint), ingestTarget, requestID, written, timeout, tlsConfig, &wg)
+	wg.Wait()
+
+	// differing data is still data of another tenant
+	var mismatch *MismatchError
+	switch {
+	case err == nil, errors.As(err, &mismatch):
+		return &IsolationError{Tenant: c.Tenant, QueryTenant: queryTenant.Name, RequestID: requestID}
+	case errors.Is(err, ErrNotVisible):
+		return nil
+	default:
+		return fmt.Errorf("tenant isolation check as %q inconclusive: %w", queryTenant.Name, err)
+	}
+}
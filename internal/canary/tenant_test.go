@@ -0,0 +1,108 @@
+package canary
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMultiTenantPrometheus keeps a fakePrometheus per X-Scope-OrgID, or one shared by all tenants when leaky
+type fakeMultiTenantPrometheus struct {
+	t       *testing.T
+	leaky   bool
+	mu      sync.Mutex
+	tenants map[string]*fakePrometheus
+}
+
+func (f *fakeMultiTenantPrometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	orgID := r.Header.Get(config.OrgIDHeader)
+	if orgID == "" {
+		http.Error(w, "no org id", http.StatusUnauthorized)
+		return
+	}
+	if f.leaky {
+		orgID = "shared"
+	}
+	f.mu.Lock()
+	prom, ok := f.tenants[orgID]
+	if !ok {
+		prom = &fakePrometheus{t: f.t}
+		f.tenants[orgID] = prom
+	}
+	f.mu.Unlock()
+	prom.ServeHTTP(w, r)
+}
+
+func TestCheckIsolation(t *testing.T) {
+	tenantA := config.Tenant{Name: "a", OrgID: "team-a"}
+	tenantB := config.Tenant{Name: "b", OrgID: "team-b"}
+
+	tests := []struct {
+		name      string
+		leaky     bool
+		queryAs   config.Tenant
+		violation bool
+		err       bool
+	}{
+		{name: "isolated", queryAs: tenantB},
+		{name: "leaky", leaky: true, queryAs: tenantB, violation: true, err: true},
+		{name: "inconclusive", queryAs: config.Tenant{Name: "anonymous"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prom := &fakeMultiTenantPrometheus{t: t, leaky: tt.leaky, tenants: map[string]*fakePrometheus{}}
+			srv := httptest.NewServer(prom)
+			defer srv.Close()
+
+			c := Canary{Name: "tenant_canary", Type: config.TypeMetrics, TimestampTolerance: 5 * time.Second, Tenant: tenantA.Name}
+			ingest := config.Endpoint{URL: srv.URL + "/api/v1/write", Protocol: config.ProtocolRemoteWrite}
+			w, err := c.InitClient(context.Background(), nil, tenantA.Endpoint(ingest), time.Second, time.Second, nil)
+			if err != nil {
+				t.Fatalf("Failed to create writer: %v", err)
+			}
+			defer w.Close()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			written, _, err := c.Write(context.Background(), w, ingest.URL, "abc", time.Second, &wg)
+			if err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+
+			query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolPrometheus}
+			wg.Add(1)
+			if err := c.Query(context.Background(), tenantA.Endpoint(query), ingest.URL, "abc", written, time.Second, nil, &wg); err != nil {
+				t.Fatalf("Expected the sample to be visible to its own tenant, got %v", err)
+			}
+
+			err = c.CheckIsolation(context.Background(), query, tt.queryAs, ingest.URL, "abc", written, time.Second, nil)
+			var violation *IsolationError
+			if errors.As(err, &violation) != tt.violation {
+				t.Errorf("Expected violation %v, got %v", tt.violation, err)
+			}
+			if (err != nil) != tt.err {
+				t.Errorf("Expected error %v, got %v", tt.err, err)
+			}
+			if tt.violation && (violation.Tenant != "a" || violation.QueryTenant != "b") {
+				t.Errorf("Expected violation of a seen by b, got %+v", violation)
+			}
+
+			prom.mu.Lock()
+			defer prom.mu.Unlock()
+			for _, p := range prom.tenants {
+				for _, q := range p.queries {
+					if !strings.Contains(q, `tenant="a"`) {
+						t.Errorf("Expected every query to select the written tenant, got %s", q)
+					}
+				}
+			}
+		})
+	}
+}
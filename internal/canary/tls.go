@@ -0,0 +1,414 @@
+package canary
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+	"google.golang.org/grpc/credentials"
+)
+
+// TLS reload instruments, no-ops until InstrumentTLS is called
+var (
+	tlsReloads        metric.Int64Counter = noop.Int64Counter{}
+	tlsReloadFailures metric.Int64Counter = noop.Int64Counter{}
+)
+
+// InstrumentTLS registers the TLS file reload counters and the endpoint certificate expiry gauge with meter
+func InstrumentTLS(meter metric.Meter) {
+	tlsReloads, _ = meter.Int64Counter(
+		"o11y_canary_tls_reloads_total",
+		metric.WithDescription("Total number of times changed CA or client certificate files were reloaded"),
+	)
+	tlsReloadFailures, _ = meter.Int64Counter(
+		"o11y_canary_tls_reload_failures_total",
+		metric.WithDescription("Total number of changed CA or client certificate files that failed to load, the previous files stay in use"),
+	)
+	_, _ = meter.Float64ObservableGauge(
+		"o11y_canary_endpoint_cert_not_after_seconds",
+		metric.WithDescription("Expiry of each certificate in the chain an endpoint presented in its last TLS handshake, as a Unix timestamp"),
+		metric.WithFloat64Callback(observeEndpointCerts),
+	)
+}
+
+// endpointCerts holds the endpointChain each endpoint presented in its last TLS handshake, by endpointKey
+// Entries of endpoints that are no longer configured are dropped by pruneEndpoints
+var endpointCerts sync.Map
+
+// endpointChain is the certificate chain presented by endpoint when asked for serverName
+type endpointChain struct {
+	endpoint   string
+	serverName string
+	chain      []*x509.Certificate
+}
+
+// endpointKey identifies the cached transport and certificate chain of an endpoint URL or gRPC target with a TLS
+// configuration, so endpoints on one host and one endpoint with different server names are told apart
+func endpointKey(target string, tlsConfig *config.TLSConfig) string {
+	return target + "\x00" + tlsKey(tlsConfig)
+}
+
+// httpServerName is the server name a handshake with the HTTP endpoint target sends: the configured one, else its
+// host, and none for IP addresses like crypto/tls. ok is false for gRPC targets
+func httpServerName(target string, serverName string) (name string, ok bool) {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	if serverName == "" {
+		serverName = u.Hostname()
+	}
+	if net.ParseIP(serverName) != nil {
+		return "", true
+	}
+	return serverName, true
+}
+
+// withPeerCertificates returns a copy of conf recording the chain target presents in every handshake
+// It runs after the chain was verified, so an expired certificate is still reported with the chain seen last.
+// Handshakes with other hosts through the same HTTP transport, e.g. after a redirect, are not recorded
+func withPeerCertificates(conf *tls.Config, target string, tlsConfig *config.TLSConfig) *tls.Config {
+	if conf == nil {
+		conf = &tls.Config{}
+	} else {
+		conf = conf.Clone()
+	}
+	key := endpointKey(target, tlsConfig)
+	serverName, isHTTP := httpServerName(target, conf.ServerName)
+	conf.VerifyConnection = func(cs tls.ConnectionState) error {
+		if isHTTP && cs.ServerName != serverName {
+			return nil
+		}
+		endpointCerts.Store(key, endpointChain{endpoint: target, serverName: conf.ServerName, chain: cs.PeerCertificates})
+		return nil
+	}
+	return conf
+}
+
+// observeEndpointCerts reports the expiry of every certificate recorded by withPeerCertificates, depth 0 is the leaf
+func observeEndpointCerts(_ context.Context, o metric.Float64Observer) error {
+	endpointCerts.Range(func(_, v any) bool {
+		ec := v.(endpointChain)
+		for depth, cert := range ec.chain {
+			o.Observe(float64(cert.NotAfter.Unix()), metric.WithAttributes(
+				attribute.String("endpoint", ec.endpoint),
+				attribute.String("server_name", ec.serverName),
+				attribute.Int("depth", depth),
+				attribute.String("subject", cert.Subject.String()),
+				attribute.String("issuer", cert.Issuer.String()),
+				attribute.String("serial_number", cert.SerialNumber.String()),
+			))
+		}
+		return true
+	})
+	return nil
+}
+
+// pruneEndpoints drops the certificate chains and transports of endpoints whose endpointKey is not in keep, closing
+// the idle connections of the transports, and the TLS sources none of them uses. Certificate expiry is then only
+// reported for configured endpoints and reloads that change a TLS configuration do not leak its transports
+func pruneEndpoints(keep map[string]bool) {
+	live := map[string]bool{}
+	for key := range keep {
+		_, tlsKey, _ := strings.Cut(key, "\x00")
+		live[tlsKey] = true
+	}
+	endpointCerts.Range(func(key, _ any) bool {
+		if !keep[key.(string)] {
+			endpointCerts.Delete(key)
+		}
+		return true
+	})
+	transports.Range(func(key, rt any) bool {
+		if !keep[key.(string)] {
+			transports.Delete(key)
+			if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+				closer.CloseIdleConnections()
+			}
+		}
+		return true
+	})
+	tlsSources.Range(func(key, _ any) bool {
+		if !live[key.(string)] {
+			tlsSources.Delete(key)
+		}
+		return true
+	})
+}
+
+// tlsSources holds one tlsSource per TLS configuration, shared by every HTTP transport and gRPC connection using it
+var tlsSources sync.Map
+
+// transports holds one HTTP transport per endpoint and TLS configuration, so queries reuse connections instead of
+// dialing and reading the CA file every time
+var transports sync.Map
+
+// tlsKey identifies a TLS configuration, disabled and missing configurations are the same
+func tlsKey(tlsConfig *config.TLSConfig) string {
+	if tlsConfig == nil || !tlsConfig.Enabled {
+		return ""
+	}
+	return fmt.Sprintf("%+v", *tlsConfig)
+}
+
+// endpointTransport returns the cached transport for target, TLS files are reloaded by the transport when they change
+func endpointTransport(target string, tlsConfig *config.TLSConfig) (http.RoundTripper, error) {
+	key := endpointKey(target, tlsConfig)
+	if rt, ok := transports.Load(key); ok {
+		return rt.(http.RoundTripper), nil
+	}
+
+	var rt http.RoundTripper
+	if tlsKey(tlsConfig) == "" {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = withPeerCertificates(nil, target, tlsConfig)
+		rt = transport
+	} else {
+		src, err := newTLSSource(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		rt = &reloadingTransport{src: src, endpoint: target}
+	}
+	actual, _ := transports.LoadOrStore(key, rt)
+	return actual.(http.RoundTripper), nil
+}
+
+// newHTTPClient returns an http.Client for ingest and query endpoints, honouring the TLS and auth configuration
+func newHTTPClient(target string, timeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) (*http.Client, error) {
+	transport, err := endpointTransport(target, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: newAuthRoundTripper(auth, transport), Timeout: timeout}, nil
+}
+
+// newTransportCredentials returns gRPC transport credentials for target that use the current TLS files on every handshake
+func newTransportCredentials(target string, tlsConfig *config.TLSConfig) (credentials.TransportCredentials, error) {
+	src, err := newTLSSource(tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &reloadingCredentials{src: src, endpoint: target}, nil
+}
+
+// tlsSource builds the client tls.Config of a TLS configuration and builds it again when its files change on disk
+// A change that fails to load is logged and counted once, the last good configuration stays in use until it is fixed
+type tlsSource struct {
+	cfg config.TLSConfig
+
+	mu          sync.Mutex
+	conf        *tls.Config
+	generation  uint64
+	loadedStamp string
+	failedStamp string
+}
+
+// newTLSSource returns the shared source of tlsConfig, failing when its files cannot be loaded
+func newTLSSource(tlsConfig *config.TLSConfig) (*tlsSource, error) {
+	key := tlsKey(tlsConfig)
+	if src, ok := tlsSources.Load(key); ok {
+		return src.(*tlsSource), nil
+	}
+	src := &tlsSource{cfg: *tlsConfig}
+	if _, _, err := src.load(); err != nil {
+		return nil, err
+	}
+	actual, _ := tlsSources.LoadOrStore(key, src)
+	return actual.(*tlsSource), nil
+}
+
+// stamp changes whenever one of the files is replaced or modified, cert-manager swaps a symlink which os.Stat follows
+func (s *tlsSource) stamp() string {
+	var stamp string
+	for _, path := range []string{s.cfg.CAFile, s.cfg.CertFile, s.cfg.KeyFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			stamp += path + " missing;"
+			continue
+		}
+		stamp += fmt.Sprintf("%s %d %d;", path, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp
+}
+
+// load returns the current tls.Config and its generation, which increases every time the files are reloaded
+func (s *tlsSource) load() (*tls.Config, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stamp := s.stamp()
+	if s.conf != nil && (stamp == s.loadedStamp || stamp == s.failedStamp) {
+		return s.conf, s.generation, nil
+	}
+
+	conf, err := newTLSConfig(&s.cfg)
+	if err != nil {
+		if s.conf == nil {
+			return nil, 0, err
+		}
+		s.failedStamp = stamp
+		tlsReloadFailures.Add(context.Background(), 1, metric.WithAttributes(s.attributes()...))
+		slog.Error("Failed to reload TLS files, keeping the previous ones", "ca_file", s.cfg.CAFile, "cert_file", s.cfg.CertFile, "error", err)
+		return s.conf, s.generation, nil
+	}
+	if s.conf != nil {
+		tlsReloads.Add(context.Background(), 1, metric.WithAttributes(s.attributes()...))
+		slog.Info("Reloaded TLS files", "ca_file", s.cfg.CAFile, "cert_file", s.cfg.CertFile)
+	}
+	s.conf = conf
+	s.generation++
+	s.loadedStamp = stamp
+	s.failedStamp = ""
+	return s.conf, s.generation, nil
+}
+
+func (s *tlsSource) attributes() []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("ca_file", s.cfg.CAFile), attribute.String("cert_file", s.cfg.CertFile)}
+}
+
+// newTLSConfig builds a client tls.Config from the canary TLS configuration, reading the CA and certificate files
+func newTLSConfig(tlsConfig *config.TLSConfig) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if version, ok := config.TLSVersions[tlsConfig.MinVersion]; ok {
+		tlsConf.MinVersion = version
+	}
+	for _, name := range tlsConfig.CipherSuites {
+		id, ok := config.CipherSuite(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		tlsConf.CipherSuites = append(tlsConf.CipherSuites, id)
+	}
+
+	if tlsConfig.CertFile != "" && tlsConfig.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificates: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+
+	if tlsConfig.CAFile != "" {
+		caCert, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to parse CA certificate")
+		}
+		tlsConf.RootCAs = caCertPool
+	}
+
+	return tlsConf, nil
+}
+
+// reloadingTransport replaces its http.Transport when the TLS files change, new requests use the new files while
+// requests in flight finish on the old connections
+type reloadingTransport struct {
+	src      *tlsSource
+	endpoint string
+
+	mu         sync.Mutex
+	transport  *http.Transport
+	generation uint64
+}
+
+func (rt *reloadingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conf, generation, err := rt.src.load()
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	rt.mu.Lock()
+	if rt.transport == nil || rt.generation != generation {
+		if rt.transport != nil {
+			rt.transport.CloseIdleConnections()
+		}
+		rt.transport = http.DefaultTransport.(*http.Transport).Clone()
+		rt.transport.TLSClientConfig = withPeerCertificates(conf, rt.endpoint, &rt.src.cfg)
+		rt.generation = generation
+	}
+	transport := rt.transport
+	rt.mu.Unlock()
+
+	return transport.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the current transport
+func (rt *reloadingTransport) CloseIdleConnections() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.transport != nil {
+		rt.transport.CloseIdleConnections()
+	}
+}
+
+// reloadingCredentials are gRPC TLS credentials built from the current TLS files on every handshake, so reconnects of
+// long-lived connections pick up rotated certificates
+type reloadingCredentials struct {
+	src      *tlsSource
+	endpoint string
+}
+
+func (c *reloadingCredentials) current() (credentials.TransportCredentials, error) {
+	conf, _, err := c.src.load()
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(withPeerCertificates(conf, c.endpoint, &c.src.cfg)), nil
+}
+
+func (c *reloadingCredentials) ClientHandshake(ctx context.Context, authority string, conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	creds, err := c.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	return creds.ClientHandshake(ctx, authority, conn)
+}
+
+func (c *reloadingCredentials) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.New("reloading TLS credentials are client only")
+}
+
+// Info is the one of the credentials built from the current TLS configuration, only the protocol is known without it
+func (c *reloadingCredentials) Info() credentials.ProtocolInfo {
+	creds, err := c.current()
+	if err != nil {
+		return credentials.ProtocolInfo{SecurityProtocol: "tls", ServerName: c.src.cfg.ServerName}
+	}
+	return creds.Info()
+}
+
+func (c *reloadingCredentials) Clone() credentials.TransportCredentials {
+	return &reloadingCredentials{src: c.src, endpoint: c.endpoint}
+}
+
+// OverrideServerName is deprecated in gRPC and unused, set server_name in the TLS configuration instead
+func (c *reloadingCredentials) OverrideServerName(string) error {
+	return errors.New("override the server name with server_name in the TLS configuration")
+}
@@ -0,0 +1,219 @@
+package canary
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/metric/noop"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+// testCA is a certificate authority issuing server certificates for localhost
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) serverCert(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "canary-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeFile writes content with a modification time in the future, so a rewrite within the same clock tick is noticed
+func writeFile(t *testing.T, path string, content []byte, offset time.Duration) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(offset)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	first, second := newTestCA(t, "first"), newTestCA(t, "second")
+
+	var serving atomic.Pointer[tls.Certificate]
+	cert := first.serverCert(t)
+	serving.Store(&cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return serving.Load(), nil }}
+	// every request handshakes again, so only reloading the CA file lets it verify the rotated certificate
+	srv.Config.SetKeepAlivesEnabled(false)
+	srv.StartTLS()
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	writeFile(t, caFile, first.pem, 0)
+	// the server name is sent as SNI, so the server picks the certificate from GetCertificate
+	tlsConfig := &config.TLSConfig{Enabled: true, CAFile: caFile, ServerName: "localhost", MinVersion: "TLS13"}
+
+	get := func() error {
+		_, err := httpGet(context.Background(), srv.URL, "/", nil, time.Second, tlsConfig, config.Auth{})
+		return err
+	}
+	if err := get(); err != nil {
+		t.Fatalf("Request with the first CA failed: %v", err)
+	}
+	issuer := func() string {
+		ec, ok := endpointCerts.Load(endpointKey(srv.URL, tlsConfig))
+		if !ok {
+			return ""
+		}
+		return ec.(endpointChain).chain[0].Issuer.CommonName
+	}
+	if got := issuer(); got != "first" {
+		t.Errorf("Expected the handshake to record the certificate issued by first, got %q", got)
+	}
+
+	a, _ := endpointTransport(srv.URL, tlsConfig)
+	b, _ := endpointTransport(srv.URL, tlsConfig)
+	if a != b {
+		t.Errorf("Expected the transport of the endpoint to be cached")
+	}
+
+	rotated := second.serverCert(t)
+	serving.Store(&rotated)
+	if err := get(); err == nil {
+		t.Fatalf("Expected the certificate of an unknown CA to be rejected")
+	}
+	writeFile(t, caFile, second.pem, time.Minute)
+	if err := get(); err != nil {
+		t.Fatalf("Request after rotating the CA file failed: %v", err)
+	}
+	if got := issuer(); got != "second" {
+		t.Errorf("Expected the rotated certificate to be recorded, got issuer %q", got)
+	}
+
+	// a broken rotation keeps the last good CA in use
+	src, _ := newTLSSource(tlsConfig)
+	_, generation, _ := src.load()
+	writeFile(t, caFile, []byte("not a certificate"), 2*time.Minute)
+	if err := get(); err != nil {
+		t.Fatalf("Request after a broken CA file failed: %v", err)
+	}
+	if _, g, _ := src.load(); g != generation || src.failedStamp == "" {
+		t.Errorf("Expected the failed reload to be recorded and the previous configuration kept")
+	}
+
+	// the chain, transport and TLS source are kept while a canary uses the endpoint and dropped once none does
+	canaries := map[string]config.CanaryConfig{"tls_canary": {Query: []config.Endpoint{{URL: srv.URL}}, TLS: tlsConfig}}
+	pruneEndpoints(endpointKeys(canaries, nil))
+	if got := issuer(); got != "second" {
+		t.Errorf("Expected the chain of a configured endpoint to be kept, got issuer %q", got)
+	}
+	if rt, _ := endpointTransport(srv.URL, tlsConfig); rt != a {
+		t.Errorf("Expected the transport of a configured endpoint to be kept")
+	}
+	if s, _ := newTLSSource(tlsConfig); s != src {
+		t.Errorf("Expected the TLS source of a configured endpoint to be kept")
+	}
+	pruneEndpoints(endpointKeys(nil, nil))
+	if got := issuer(); got != "" {
+		t.Errorf("Expected the chain of a removed endpoint to be dropped, got issuer %q", got)
+	}
+	if _, ok := transports.Load(endpointKey(srv.URL, tlsConfig)); ok {
+		t.Errorf("Expected the transport of a removed endpoint to be dropped")
+	}
+	if _, ok := tlsSources.Load(tlsKey(tlsConfig)); ok {
+		t.Errorf("Expected the TLS source no endpoint uses to be dropped")
+	}
+}
+
+func TestEndpointCertMetric(t *testing.T) {
+	ca := newTestCA(t, "collector-ca")
+	leaf, _ := x509.ParseCertificate(ca.serverCert(t).Certificate[0])
+	endpointCerts.Store("collector", endpointChain{endpoint: "otel-collector:4317", serverName: "collector.internal", chain: []*x509.Certificate{leaf, ca.cert}})
+	defer endpointCerts.Delete("collector")
+
+	reader := sdkmetric.NewManualReader()
+	InstrumentTLS(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)).Meter("test"))
+	defer InstrumentTLS(noop.Meter{})
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+	got := map[int64]float64{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != "o11y_canary_endpoint_cert_not_after_seconds" {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Gauge[float64]).DataPoints {
+				if endpoint, _ := dp.Attributes.Value("endpoint"); endpoint.AsString() != "otel-collector:4317" {
+					continue
+				}
+				depth, _ := dp.Attributes.Value("depth")
+				got[depth.AsInt64()] = dp.Value
+				if issuer, _ := dp.Attributes.Value("issuer"); issuer.AsString() != "CN=collector-ca" {
+					t.Errorf("Expected issuer CN=collector-ca, got %q", issuer.AsString())
+				}
+				if serverName, _ := dp.Attributes.Value("server_name"); serverName.AsString() != "collector.internal" {
+					t.Errorf("Expected server name collector.internal, got %q", serverName.AsString())
+				}
+			}
+		}
+	}
+	if got[0] != float64(leaf.NotAfter.Unix()) || got[1] != float64(ca.cert.NotAfter.Unix()) {
+		t.Errorf("Expected the expiry of the leaf and the CA, got %v", got)
+	}
+}
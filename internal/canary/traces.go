@@ -0,0 +1,248 @@
+package canary
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"o11y-canary/internal/config"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+)
+
+// canariedSpanName is the name of the synthetic span exported by traces canaries
+const canariedSpanName = "o11y-canary-span"
+
+func init() {
+	RegisterMonitor(config.TypeTraces, func(c *Canary) Monitor { return &tracesMonitor{c: c} })
+}
+
+// tracesMonitor exports single span traces and fetches them back by trace ID or TraceQL
+type tracesMonitor struct {
+	c *Canary
+}
+
+// NewWriter provides the OTLP trace client
+func (m *tracesMonitor) NewWriter(ctx context.Context, res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig) (Writer, error) {
+	return newTraceWriter(res, endpoint, timeout, tlsConfig, &m.c.traceIDs)
+}
+
+// Write exports a span carrying a random value under a fresh trace ID, which the result carries for the queries
+func (m *tracesMonitor) Write(ctx context.Context, writer Writer, check Check) (WriteResult, error) {
+	written, err := m.c.writeSample(ctx, writer, check)
+	if err != nil {
+		return written, err
+	}
+	traceID, ok := m.c.traceIDs.LoadAndDelete(writeKey(check.IngestTarget, check.RequestID, written.Timestamp))
+	if !ok {
+		return WriteResult{}, fmt.Errorf("writer %s did not record a trace ID", writer.Protocol())
+	}
+	written.TraceID = traceID.(string)
+	return written, nil
+}
+
+// Query looks up the trace written by the check
+func (m *tracesMonitor) Query(ctx context.Context, endpoint config.Endpoint, check Check, tlsConfig *config.TLSConfig) (QueryResult, error) {
+	switch endpoint.Protocol {
+	case config.ProtocolTempo, config.ProtocolJaeger, "":
+		return QueryResult{}, m.c.queryTraceByID(ctx, endpoint.URL, check.RequestID, check.Written, check.Timeout, tlsConfig, endpoint.Auth)
+	case config.ProtocolTraceQL:
+		return QueryResult{}, m.c.queryTraceQL(ctx, endpoint.URL, check.IngestTarget, check.RequestID, check.Written, check.Timeout, tlsConfig, endpoint.Auth)
+	default:
+		return QueryResult{}, fmt.Errorf("unsupported query protocol %q for traces", endpoint.Protocol)
+	}
+}
+
+// newTraceWriter returns a Writer exporting one synthetic span per sample over OTLP
+// The trace ID of every write is kept in traceIDs under its ingest target and request ID so queries can fetch it back
+func newTraceWriter(res *resource.Resource, endpoint config.Endpoint, timeout time.Duration, tlsConfig *config.TLSConfig, traceIDs *sync.Map) (Writer, error) {
+	w := &traceWriter{
+		protocol: endpoint.Protocol,
+		resource: resourceToProto(res),
+		traceIDs: traceIDs,
+	}
+
+	switch endpoint.Protocol {
+	case config.ProtocolGRPC, "":
+		conn, err := newGRPCConn(endpoint.URL, endpoint.Compression, tlsConfig, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		w.protocol = config.ProtocolGRPC
+		w.conn = conn
+		w.grpcClient = coltracepb.NewTraceServiceClient(conn)
+	case config.ProtocolHTTPProtobuf, config.ProtocolHTTPJSON:
+		client, err := newOTLPHTTPClient(endpoint.URL, endpoint.Protocol, endpoint.Compression, timeout, tlsConfig, endpoint.Auth)
+		if err != nil {
+			return nil, err
+		}
+		w.httpClient = client
+	default:
+		return nil, fmt.Errorf("unsupported ingest protocol %q for traces", endpoint.Protocol)
+	}
+	return w, nil
+}
+
+// traceWriter sends a new single span trace per canaried sample
+type traceWriter struct {
+	protocol   string
+	resource   *resourcepb.Resource
+	conn       *grpc.ClientConn
+	grpcClient coltracepb.TraceServiceClient
+	httpClient *otlpHTTPClient
+	traceIDs   *sync.Map
+}
+
+// WriteSample exports a span carrying the labels and value as attributes under a fresh trace ID
+func (w *traceWriter) WriteSample(ctx context.Context, labels []attribute.KeyValue, value float64, ts time.Time) error {
+	traceID := make([]byte, 16)
+	spanID := make([]byte, 8)
+	if _, err := rand.Read(traceID); err != nil {
+		return fmt.Errorf("failed to generate trace ID: %w", err)
+	}
+	if _, err := rand.Read(spanID); err != nil {
+		return fmt.Errorf("failed to generate span ID: %w", err)
+	}
+
+	attrs := append(attributesToProto(labels), &commonpb.KeyValue{
+		Key:   "value",
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: value}},
+	})
+	req := &coltracepb.ExportTraceServiceRequest{
+		ResourceSpans: []*tracepb.ResourceSpans{{
+			Resource: w.resource,
+			ScopeSpans: []*tracepb.ScopeSpans{{
+				Scope: &commonpb.InstrumentationScope{Name: "o11y-canary-exported-data"},
+				Spans: []*tracepb.Span{{
+					TraceId:           traceID,
+					SpanId:            spanID,
+					Name:              canariedSpanName,
+					Kind:              tracepb.Span_SPAN_KIND_INTERNAL,
+					StartTimeUnixNano: uint64(ts.Add(-time.Millisecond).UnixNano()),
+					EndTimeUnixNano:   uint64(ts.UnixNano()),
+					Attributes:        attrs,
+					Status:            &tracepb.Status{Code: tracepb.Status_STATUS_CODE_OK},
+				}},
+			}},
+		}},
+	}
+
+	var err error
+	if w.grpcClient != nil {
+		_, err = w.grpcClient.Export(ctx, req)
+		if err != nil {
+			err = fmt.Errorf("OTLP traces export failed: %w", err)
+		}
+	} else {
+		err = w.httpClient.export(ctx, "traces", req, &coltracepb.ExportTraceServiceResponse{})
+	}
+	if err != nil {
+		return err
+	}
+
+	var target, requestID string
+	for _, kv := range labels {
+		switch kv.Key {
+		case "target":
+			target = kv.Value.AsString()
+		case "canary_request_id":
+			requestID = kv.Value.AsString()
+		}
+	}
+	w.traceIDs.Store(writeKey(target, requestID, ts), hex.EncodeToString(traceID))
+	return nil
+}
+
+// Protocol returns the OTLP transport
+func (w *traceWriter) Protocol() string {
+	return w.protocol
+}
+
+// Close releases the grpc connection or idle http connections
+func (w *traceWriter) Close() {
+	if w.conn != nil {
+		w.conn.Close()
+	}
+	if w.httpClient != nil {
+		w.httpClient.client.CloseIdleConnections()
+	}
+}
+
+// queryTraceByID fetches the canaried trace from the Tempo or Jaeger trace by ID API
+// both answer /api/traces/<id> with 404 until the trace is searchable
+func (c *Canary) queryTraceByID(ctx context.Context, target string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) error {
+	traceID := written.TraceID
+	slog.Debug("Querying trace", "target", target, "trace_id", traceID, "canary_request_id", requestID)
+
+	body, err := httpGet(ctx, target, "/api/traces/"+traceID, url.Values{}, queryTimeout, tlsConfig, auth)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("trace %s not found for target %s with request ID %s: %w: %w", traceID, target, requestID, ErrNotVisible, err)
+	}
+	if err != nil {
+		return fmt.Errorf("trace %s not found for target %s with request ID %s: %w", traceID, target, requestID, err)
+	}
+	if strings.TrimSpace(string(body)) == "" {
+		return fmt.Errorf("trace %s not found for target %s with request ID %s: %w", traceID, target, requestID, ErrNotVisible)
+	}
+
+	slog.Debug("Query successful", "target", target, "trace_id", traceID, "canary_request_id", requestID)
+	return nil
+}
+
+type traceQLSearchResponse struct {
+	Traces []struct {
+		TraceID string `json:"traceID"`
+	} `json:"traces"`
+}
+
+// queryTraceQL finds the canaried trace with a Tempo TraceQL search on the request ID attribute
+func (c *Canary) queryTraceQL(ctx context.Context, target string, ingestTarget string, requestID string, written WriteResult, queryTimeout time.Duration, tlsConfig *config.TLSConfig, auth config.Auth) error {
+	traceID := written.TraceID
+	slog.Debug("Searching trace with TraceQL", "target", target, "trace_id", traceID, "canary_request_id", requestID)
+
+	params := url.Values{}
+	filter := fmt.Sprintf(`span.canary_request_id = %q && span.target = %q`, requestID, ingestTarget)
+	if c.Tenant != "" {
+		filter += fmt.Sprintf(` && span.tenant = %q`, c.Tenant)
+	}
+	params.Set("q", "{ "+filter+" }")
+	params.Set("start", strconv.FormatInt(queryStart(written).Unix(), 10))
+	params.Set("end", strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10))
+
+	body, err := httpGet(ctx, target, "/api/search", params, queryTimeout, tlsConfig, auth)
+	if err != nil {
+		return err
+	}
+
+	var resp traceQLSearchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("failed to decode TraceQL response: %w", err)
+	}
+	// Tempo drops leading zeros from trace IDs in search results
+	want := strings.TrimLeft(traceID, "0")
+	for _, t := range resp.Traces {
+		if strings.TrimLeft(t.TraceID, "0") == want {
+			slog.Debug("Query successful", "target", target, "trace_id", traceID, "canary_request_id", requestID)
+			return nil
+		}
+	}
+
+	slog.Warn("Trace not found in TraceQL search", "target", target, "trace_id", traceID, "canary_request_id", requestID)
+	return fmt.Errorf("trace %s not found in TraceQL search for target %s with request ID %s: %w", traceID, target, requestID, ErrNotVisible)
+}
@@ -0,0 +1,103 @@
+package canary
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"o11y-canary/internal/config"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTempo accepts OTLP/JSON traces and serves them back by ID, delay after they were received
+type fakeTempo struct {
+	mu       sync.Mutex
+	delay    time.Duration
+	traceIDs map[string]time.Time
+}
+
+func (f *fakeTempo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v1/traces":
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct {
+						TraceID string `json:"traceId"`
+					} `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, s := range ss.Spans {
+					f.traceIDs[s.TraceID] = time.Now().Add(f.delay)
+				}
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	case strings.HasPrefix(r.URL.Path, "/api/traces/"):
+		visibleAt, ok := f.traceIDs[strings.TrimPrefix(r.URL.Path, "/api/traces/")]
+		if !ok || time.Now().Before(visibleAt) {
+			http.Error(w, "trace not found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"batches":[]}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeTempoServer() *httptest.Server {
+	return newDelayedTempoServer(0)
+}
+
+// newDelayedTempoServer serves traces only delay after they were written, like a backend that is slow to index them
+func newDelayedTempoServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(&fakeTempo{delay: delay, traceIDs: map[string]time.Time{}})
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	srv := newFakeTempoServer()
+	defer srv.Close()
+
+	c := Canary{Name: "traces_canary", Type: config.TypeTraces}
+
+	w, err := c.InitClient(context.Background(), nil, config.Endpoint{URL: srv.URL, Protocol: config.ProtocolHTTPJSON}, time.Second, time.Second, nil)
+	if err != nil {
+		t.Fatalf("Failed to create writer: %v", err)
+	}
+	defer w.Close()
+
+	query := config.Endpoint{URL: srv.URL, Protocol: config.ProtocolTempo}
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, srv.URL, "abc123", WriteResult{}, time.Second, nil, &wg); err == nil {
+		t.Errorf("Expected error before any trace was written")
+	}
+
+	wg.Add(1)
+	written, _, err := c.Write(context.Background(), w, srv.URL, "abc123", time.Second, &wg)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	if len(written.TraceID) != 32 {
+		t.Fatalf("Expected the hex trace ID to be returned, got %q", written.TraceID)
+	}
+
+	wg.Add(1)
+	if err := c.Query(context.Background(), query, srv.URL, "abc123", written, time.Second, nil, &wg); err != nil {
+		t.Errorf("Expected written trace to be found, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package canary
+
+import (
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+)
+
+// resourceMetricsToProto converts SDK metric data into the OTLP wire format
+// Only the aggregations the canary produces (gauges, sums and histograms) are handled
+func resourceMetricsToProto(rm *metricdata.ResourceMetrics) []*metricpb.ResourceMetrics {
+	if rm == nil {
+		return nil
+	}
+
+	scopeMetrics := make([]*metricpb.ScopeMetrics, 0, len(rm.ScopeMetrics))
+	for _, sm := range rm.ScopeMetrics {
+		metrics := make([]*metricpb.Metric, 0, len(sm.Metrics))
+		for _, m := range sm.Metrics {
+			pm := &metricpb.Metric{
+				Name:        m.Name,
+				Description: m.Description,
+				Unit:        m.Unit,
+			}
+			switch data := m.Data.(type) {
+			case metricdata.Gauge[float64]:
+				pm.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: numberDataPoints(data.DataPoints)}}
+			case metricdata.Gauge[int64]:
+				pm.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: numberDataPoints(data.DataPoints)}}
+			case metricdata.Sum[float64]:
+				pm.Data = &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+					AggregationTemporality: temporalityToProto(data.Temporality),
+					IsMonotonic:            data.IsMonotonic,
+					DataPoints:             numberDataPoints(data.DataPoints),
+				}}
+			case metricdata.Sum[int64]:
+				pm.Data = &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+					AggregationTemporality: temporalityToProto(data.Temporality),
+					IsMonotonic:            data.IsMonotonic,
+					DataPoints:             numberDataPoints(data.DataPoints),
+				}}
+			case metricdata.Histogram[float64]:
+				pm.Data = &metricpb.Metric_Histogram{Histogram: &metricpb.Histogram{
+					AggregationTemporality: temporalityToProto(data.Temporality),
+					DataPoints:             histogramDataPoints(data.DataPoints),
+				}}
+			case metricdata.Histogram[int64]:
+				pm.Data = &metricpb.Metric_Histogram{Histogram: &metricpb.Histogram{
+					AggregationTemporality: temporalityToProto(data.Temporality),
+					DataPoints:             histogramDataPoints(data.DataPoints),
+				}}
+			default:
+				slog.Debug("Skipping unsupported metric aggregation for OTLP HTTP export", "metric", m.Name)
+				continue
+			}
+			metrics = append(metrics, pm)
+		}
+		scopeMetrics = append(scopeMetrics, &metricpb.ScopeMetrics{
+			Scope: &commonpb.InstrumentationScope{
+				Name:    sm.Scope.Name,
+				Version: sm.Scope.Version,
+			},
+			SchemaUrl: sm.Scope.SchemaURL,
+			Metrics:   metrics,
+		})
+	}
+
+	return []*metricpb.ResourceMetrics{{
+		Resource:     resourceToProto(rm.Resource),
+		SchemaUrl:    rm.Resource.SchemaURL(),
+		ScopeMetrics: scopeMetrics,
+	}}
+}
+
+func resourceToProto(res *resource.Resource) *resourcepb.Resource {
+	if res == nil {
+		return &resourcepb.Resource{}
+	}
+	return &resourcepb.Resource{Attributes: attributesToProto(res.Attributes())}
+}
+
+func numberDataPoints[N int64 | float64](dps []metricdata.DataPoint[N]) []*metricpb.NumberDataPoint {
+	out := make([]*metricpb.NumberDataPoint, 0, len(dps))
+	for _, dp := range dps {
+		pdp := &metricpb.NumberDataPoint{
+			Attributes:        attributesToProto(dp.Attributes.ToSlice()),
+			StartTimeUnixNano: timeUnixNano(dp.StartTime),
+			TimeUnixNano:      timeUnixNano(dp.Time),
+		}
+		switch v := any(dp.Value).(type) {
+		case int64:
+			pdp.Value = &metricpb.NumberDataPoint_AsInt{AsInt: v}
+		case float64:
+			pdp.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: v}
+		}
+		out = append(out, pdp)
+	}
+	return out
+}
+
+func histogramDataPoints[N int64 | float64](dps []metricdata.HistogramDataPoint[N]) []*metricpb.HistogramDataPoint {
+	out := make([]*metricpb.HistogramDataPoint, 0, len(dps))
+	for _, dp := range dps {
+		sum := float64(dp.Sum)
+		pdp := &metricpb.HistogramDataPoint{
+			Attributes:        attributesToProto(dp.Attributes.ToSlice()),
+			StartTimeUnixNano: timeUnixNano(dp.StartTime),
+			TimeUnixNano:      timeUnixNano(dp.Time),
+			Count:             dp.Count,
+			Sum:               &sum,
+			BucketCounts:      dp.BucketCounts,
+			ExplicitBounds:    dp.Bounds,
+		}
+		if v, ok := dp.Min.Value(); ok {
+			minV := float64(v)
+			pdp.Min = &minV
+		}
+		if v, ok := dp.Max.Value(); ok {
+			maxV := float64(v)
+			pdp.Max = &maxV
+		}
+		out = append(out, pdp)
+	}
+	return out
+}
+
+func temporalityToProto(t metricdata.Temporality) metricpb.AggregationTemporality {
+	switch t {
+	case metricdata.DeltaTemporality:
+		return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	case metricdata.CumulativeTemporality:
+		return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	default:
+		return metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_UNSPECIFIED
+	}
+}
+
+// attributesToProto converts otel attributes into OTLP key values
+func attributesToProto(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	out := make([]*commonpb.KeyValue, 0, len(attrs))
+	for _, kv := range attrs {
+		out = append(out, &commonpb.KeyValue{Key: string(kv.Key), Value: attributeValueToProto(kv.Value)})
+	}
+	return out
+}
+
+func attributeValueToProto(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	case attribute.STRING:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.AsString()}}
+	default:
+		// slices are rare in canary attributes, send them as their string form
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.Emit()}}
+	}
+}
+
+func timeUnixNano(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
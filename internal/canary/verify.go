@@ -0,0 +1,77 @@
+package canary
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Reasons reported by MismatchError and the o11y_canary_data_mismatch_total reason label
+const (
+	// MismatchValue means data newer than the write is visible but the written value is not
+	MismatchValue = "value"
+	// MismatchTimestamp means the written value is visible but stamped outside the timestamp tolerance
+	MismatchTimestamp = "timestamp"
+)
+
+// MismatchError is returned by Query when canaried data is visible but differs from what was written
+type MismatchError struct {
+	Reason        string
+	ExpectedValue float64
+	ActualValue   float64
+	ExpectedTime  time.Time
+	ActualTime    time.Time
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%s mismatch: wrote %v at %s, queried %v at %s",
+		e.Reason, e.ExpectedValue, e.ExpectedTime.Format(time.RFC3339Nano), e.ActualValue, e.ActualTime.Format(time.RFC3339Nano))
+}
+
+// writeKey identifies a single write of requestID through target, the series is written again every interval
+func writeKey(target string, requestID string, ts time.Time) string {
+	return target + "/" + requestID + "/" + strconv.FormatInt(ts.UnixNano(), 10)
+}
+
+// verifySamples checks the raw samples of the canaried series against the written sample and returns the one it judged
+// A sample with the written value within the timestamp tolerance is a match. Anything stamped
+// at or before the write (plus tolerance) is ignored, OTLP re-exports the previous value of a
+// gauge until it is recorded again so those samples say nothing about this write.
+func verifySamples(samples []model.SamplePair, written WriteResult, valueTolerance float64, timestampTolerance time.Duration) (model.SamplePair, error) {
+	var newer *model.SamplePair
+	for i, s := range samples {
+		ts := s.Timestamp.Time()
+		valueMatches := math.Abs(float64(s.Value)-written.Value) <= valueTolerance
+		diff := ts.Sub(written.Timestamp)
+
+		if valueMatches && diff.Abs() <= timestampTolerance {
+			return s, nil
+		}
+		if valueMatches && diff > timestampTolerance {
+			return s, &MismatchError{
+				Reason:        MismatchTimestamp,
+				ExpectedValue: written.Value,
+				ActualValue:   float64(s.Value),
+				ExpectedTime:  written.Timestamp,
+				ActualTime:    ts,
+			}
+		}
+		if diff > timestampTolerance && newer == nil {
+			newer = &samples[i]
+		}
+	}
+
+	if newer != nil {
+		return *newer, &MismatchError{
+			Reason:        MismatchValue,
+			ExpectedValue: written.Value,
+			ActualValue:   float64(newer.Value),
+			ExpectedTime:  written.Timestamp,
+			ActualTime:    newer.Timestamp.Time(),
+		}
+	}
+	return model.SamplePair{}, fmt.Errorf("sample written at %s: %w", written.Timestamp.Format(time.RFC3339Nano), ErrNotVisible)
+}
@@ -0,0 +1,50 @@
+package canary
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+func TestVerifySamples(t *testing.T) {
+	written := WriteResult{Value: 4242, Timestamp: time.Unix(1000, 0)}
+	at := func(offset time.Duration, v float64) model.SamplePair {
+		return model.SamplePair{Timestamp: model.TimeFromUnixNano(written.Timestamp.Add(offset).UnixNano()), Value: model.SampleValue(v)}
+	}
+
+	tests := []struct {
+		name    string
+		samples []model.SamplePair
+		reason  string // empty for a match
+		visible bool
+	}{
+		{"exact match", []model.SamplePair{at(0, 4242)}, "", true},
+		{"match within tolerance after stale re-export", []model.SamplePair{at(-time.Second, 17), at(200*time.Millisecond, 4242)}, "", true},
+		{"only stale data", []model.SamplePair{at(-10*time.Second, 17), at(-time.Second, 17)}, "", false},
+		{"wrong value", []model.SamplePair{at(-time.Second, 17), at(10*time.Second, 18)}, MismatchValue, true},
+		{"shifted timestamp", []model.SamplePair{at(-time.Second, 17), at(time.Minute, 4242)}, MismatchTimestamp, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := verifySamples(tt.samples, written, 0, 5*time.Second)
+			var mismatch *MismatchError
+			switch {
+			case tt.reason == "" && tt.visible:
+				if err != nil {
+					t.Errorf("Expected match, got %v", err)
+				}
+			case tt.reason == "":
+				if !errors.Is(err, ErrNotVisible) || errors.As(err, &mismatch) {
+					t.Errorf("Expected not visible error, got %v", err)
+				}
+			default:
+				if !errors.As(err, &mismatch) || mismatch.Reason != tt.reason {
+					t.Errorf("Expected %s mismatch, got %v", tt.reason, err)
+				}
+			}
+		})
+	}
+}
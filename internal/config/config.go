@@ -1,38 +1,396 @@
 package config
 
-import "time"
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
-// TLSConfig represents TLS configuration
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Supported values for CanaryConfig.Type
+const (
+	// TypeMetrics writes a gauge and queries it back with PromQL, the default
+	TypeMetrics = "metrics"
+	// TypeLogs writes a log line and finds it again with LogQL or LogsQL
+	TypeLogs = "logs"
+	// TypeTraces exports a span and fetches its trace by ID
+	TypeTraces = "traces"
+)
+
+// Supported values for Endpoint.Protocol on ingest endpoints
+const (
+	// ProtocolGRPC pushes OTLP over gRPC and is the default
+	ProtocolGRPC = "grpc"
+	// ProtocolHTTPProtobuf pushes OTLP over HTTP encoded as protobuf
+	ProtocolHTTPProtobuf = "http/protobuf"
+	// ProtocolHTTPJSON pushes OTLP over HTTP encoded as JSON
+	ProtocolHTTPJSON = "http/json"
+	// ProtocolRemoteWrite pushes Prometheus remote write (snappy compressed protobuf)
+	ProtocolRemoteWrite = "remote_write"
+	// ProtocolLoki pushes to the Loki push API on ingest endpoints and queries LogQL with query_range on query endpoints
+	ProtocolLoki = "loki"
+)
+
+// Supported values for Endpoint.Protocol on query endpoints, in addition to ProtocolLoki
+const (
+	// ProtocolPrometheus queries the Prometheus HTTP API with PromQL, the default for metrics canaries
+	ProtocolPrometheus = "prometheus"
+	// ProtocolLogsQL queries VictoriaLogs with LogsQL
+	ProtocolLogsQL = "logsql"
+	// ProtocolTempo fetches traces by ID from the Tempo API, the default for traces canaries
+	ProtocolTempo = "tempo"
+	// ProtocolJaeger fetches traces by ID from the Jaeger query API
+	ProtocolJaeger = "jaeger"
+	// ProtocolTraceQL searches Tempo with TraceQL for the canaried span
+	ProtocolTraceQL = "traceql"
+)
+
+// Supported values for Endpoint.Compression
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+)
+
+// TLSConfig represents TLS configuration, CA and client certificate files are reloaded when they change on disk
 type TLSConfig struct {
-	Enabled            bool   `yaml:"enabled"`
-	CAFile             string `yaml:"ca_file"`
-	CertFile           string `yaml:"cert_file"`
-	KeyFile            string `yaml:"key_file"`
-	ServerName         string `yaml:"server_name"`
-	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+	Enabled            bool     `yaml:"enabled"`
+	CAFile             string   `yaml:"ca_file"`
+	CertFile           string   `yaml:"cert_file"`
+	KeyFile            string   `yaml:"key_file"`
+	ServerName         string   `yaml:"server_name"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	MinVersion         string   `yaml:"min_version,omitempty"`   // TLS10, TLS11, TLS12 (default) or TLS13
+	CipherSuites       []string `yaml:"cipher_suites,omitempty"` // Go cipher suite names, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+}
+
+// TLSVersions maps the supported TLSConfig.MinVersion values to their crypto/tls versions
+var TLSVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// CipherSuite returns the ID of the named cipher suite, insecure suites are accepted for legacy endpoints
+func CipherSuite(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// BasicAuth represents HTTP basic authentication, the password is read from password_file on every request when set
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password,omitempty"`
+	PasswordFile string `yaml:"password_file,omitempty"`
+}
+
+// OAuth2 represents the OAuth2 client credentials flow, tokens are cached until shortly before they expire
+type OAuth2 struct {
+	ClientID         string            `yaml:"client_id"`
+	ClientSecret     string            `yaml:"client_secret,omitempty"`
+	ClientSecretFile string            `yaml:"client_secret_file,omitempty"` // read on every token fetch
+	TokenURL         string            `yaml:"token_url"`
+	Scopes           []string          `yaml:"scopes,omitempty"`
+	EndpointParams   map[string]string `yaml:"endpoint_params,omitempty"`
+}
+
+// SigV4 represents AWS Signature Version 4 request signing, e.g. for Amazon Managed Service for Prometheus
+// Without access_key the credentials come from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables or a profile of the shared credentials file
+type SigV4 struct {
+	Region    string `yaml:"region"`
+	AccessKey string `yaml:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty"`
+	Profile   string `yaml:"profile,omitempty"`  // shared credentials file profile, defaults to AWS_PROFILE or default
+	RoleARN   string `yaml:"role_arn,omitempty"` // role assumed through STS with the credentials above
+	Service   string `yaml:"service,omitempty"`  // signing service name, defaults to aps
+}
+
+// Auth represents the credentials and headers sent with every request to an endpoint
+// Set on a canary it is the default for its endpoints, see CanaryConfig.applyDefaults
+type Auth struct {
+	BasicAuth       *BasicAuth        `yaml:"basic_auth,omitempty"`
+	BearerToken     string            `yaml:"bearer_token,omitempty"`
+	BearerTokenFile string            `yaml:"bearer_token_file,omitempty"` // read on every request so rotated tokens are picked up
+	OAuth2          *OAuth2           `yaml:"oauth2,omitempty"`
+	SigV4           *SigV4            `yaml:"sigv4,omitempty"`
+	Headers         map[string]string `yaml:"headers,omitempty"`
 }
 
 // Endpoint represents an endpoint with optional TLS configuration
 type Endpoint struct {
-	URL string     `yaml:"url"`
-	TLS *TLSConfig `yaml:"tls,omitempty"`
+	URL         string     `yaml:"url"`
+	Protocol    string     `yaml:"protocol,omitempty"`    // ingest: grpc (default), http/protobuf, http/json, remote_write or loki. query: prometheus, loki, logsql, tempo, jaeger or traceql
+	Compression string     `yaml:"compression,omitempty"` // none (default) or gzip, remote write is always snappy
+	TLS         *TLSConfig `yaml:"tls,omitempty"`
+	Auth        `yaml:",inline"`
+}
+
+// TenantPlaceholder in endpoint URLs is replaced with Tenant.Path, e.g. https://vminsert:8480/insert/{tenant}/prometheus
+const TenantPlaceholder = "{tenant}"
+
+// OrgIDHeader carries the tenant of Mimir, Loki and Tempo requests
+const OrgIDHeader = "X-Scope-OrgID"
+
+// Tenant is a tenant of a multi-tenant backend that a canary writes and queries as
+type Tenant struct {
+	// Name is the tenant label on the canaried data and the o11y_canary_* metrics
+	Name string `yaml:"name"`
+	// OrgID is sent in the X-Scope-OrgID header
+	OrgID string `yaml:"org_id,omitempty"`
+	// AccountID and ProjectID replace {tenant} in endpoint URLs as AccountID:ProjectID, as VictoriaMetrics cluster expects
+	AccountID string `yaml:"account_id,omitempty"`
+	ProjectID string `yaml:"project_id,omitempty"`
+}
+
+// RetryPolicy retries writes or queries that failed with a retryable status code or a refused or reset connection
+type RetryPolicy struct {
+	MaxAttempts       int           `yaml:"max_attempts,omitempty"`       // including the first attempt, default 3
+	InitialBackoff    time.Duration `yaml:"initial_backoff,omitempty"`    // wait before the first retry, default 100ms
+	MaxBackoff        time.Duration `yaml:"max_backoff,omitempty"`        // upper bound on the wait, default 2s
+	BackoffMultiplier float64       `yaml:"backoff_multiplier,omitempty"` // applied to the wait after each retry, default 2
+	Jitter            *float64      `yaml:"jitter,omitempty"`             // random fraction added or removed from each wait, default 0.2, 0 for none
+	// HTTP status codes that are retried, gRPC codes count as their HTTP equivalent. default 429, 502, 503 and 504
+	RetryableStatusCodes []int `yaml:"retryable_status_codes,omitempty"`
+}
+
+func (r *RetryPolicy) applyDefaults() {
+	if r == nil {
+		return
+	}
+	if r.MaxAttempts == 0 {
+		r.MaxAttempts = 3
+	}
+	if r.InitialBackoff == 0 {
+		r.InitialBackoff = 100 * time.Millisecond
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = 2 * time.Second
+	}
+	if r.BackoffMultiplier == 0 {
+		r.BackoffMultiplier = 2
+	}
+	if r.Jitter == nil {
+		r.Jitter = float64Ptr(0.2)
+	}
+	if len(r.RetryableStatusCodes) == 0 {
+		r.RetryableStatusCodes = []int{429, 502, 503, 504}
+	}
+}
+
+// Path returns the AccountID:ProjectID URL path segment of the tenant, or just AccountID without a project
+func (t Tenant) Path() string {
+	if t.ProjectID == "" {
+		return t.AccountID
+	}
+	return t.AccountID + ":" + t.ProjectID
+}
+
+// Endpoint returns e as used by the tenant, with {tenant} in the URL replaced and the X-Scope-OrgID header set
+func (t Tenant) Endpoint(e Endpoint) Endpoint {
+	if t.AccountID != "" {
+		e.URL = strings.ReplaceAll(e.URL, TenantPlaceholder, t.Path())
+	}
+	if t.OrgID != "" {
+		headers := make(map[string]string, len(e.Headers)+1)
+		for name, value := range e.Headers {
+			headers[name] = value
+		}
+		headers[OrgIDHeader] = t.OrgID
+		e.Headers = headers
+	}
+	return e
 }
 
 // CanaryConfig defines the configuration for a single canary
 type CanaryConfig struct {
 	Type string `yaml:"type"`
 	// give ingest and query endpoints their own endpoint struct for distinct TLS settings but still have global defaults
-	TLS              *TLSConfig        `yaml:"tls,omitempty"`
+	TLS *TLSConfig `yaml:"tls,omitempty"`
+	// default credentials and headers of the ingest and query endpoints
+	Auth             `yaml:",inline"`
 	Ingest           []Endpoint        `yaml:"ingest"`
 	Query            []Endpoint        `yaml:"query"`
 	AdditionalLabels map[string]string `yaml:"additional_labels"`
-	Interval         time.Duration     `yaml:"interval"`
-	WriteTimeout     time.Duration     `yaml:"write_timeout"`
-	QueryTimeout     time.Duration     `yaml:"query_timeout"`
-	MaxActiveSeries  int               `yaml:"max_active_canaried_series"` // cardinality limit on maximum active series in rotation
+	Interval         time.Duration     `yaml:"interval"` // default of write_interval and query_interval
+	// every series is written each write_interval and queried back after at most one write per query_interval,
+	// of which query_sample_ratio are actually queried, so query load can be kept lower than write frequency
+	WriteInterval    time.Duration `yaml:"write_interval,omitempty"`
+	QueryInterval    time.Duration `yaml:"query_interval,omitempty"`
+	QuerySampleRatio float64       `yaml:"query_sample_ratio,omitempty"`
+	WriteTimeout     time.Duration `yaml:"write_timeout"`
+	QueryTimeout     time.Duration `yaml:"query_timeout"`
+	MaxActiveSeries  int           `yaml:"max_active_canaried_series"` // cardinality limit on maximum active series in rotation
+	// checks of the series are spread across the interval, each delayed by up to schedule_jitter of its slot. default
+	// 0.2, an explicit 0 keeps the slots exact
+	ScheduleJitter      *float64 `yaml:"schedule_jitter,omitempty"`
+	MaxConcurrentChecks int      `yaml:"max_concurrent_checks"`
+	// tolerances used when comparing the queried sample against the written one
+	ValueTolerance     float64       `yaml:"value_tolerance"`
+	TimestampTolerance time.Duration `yaml:"timestamp_tolerance"`
+	// query polling after a write, retried until the sample is visible or query_timeout passes
+	QueryInitialDelay    time.Duration `yaml:"query_initial_delay"`
+	QueryPollInterval    time.Duration `yaml:"query_poll_interval"`
+	QueryPollBackoff     float64       `yaml:"query_poll_backoff"`
+	QueryPollMaxInterval time.Duration `yaml:"query_poll_max_interval"`
+	// transient failures of a single write or query are retried within write_timeout and the query timeout
+	WriteRetry *RetryPolicy `yaml:"write_retry,omitempty"`
+	QueryRetry *RetryPolicy `yaml:"query_retry,omitempty"`
+	// every tenant is written and queried separately, with tenant_isolation_check its data must not be visible to the others
+	Tenants              []Tenant `yaml:"tenants,omitempty"`
+	TenantIsolationCheck bool     `yaml:"tenant_isolation_check,omitempty"`
 }
 
 // CanariesConfig holds multiple canary configurations
 type CanariesConfig struct {
 	Canaries map[string]CanaryConfig `yaml:"canary"`
+	// InternalMetrics optionally pushes the canary's own o11y_canary_* metrics, in addition to serving them on /metrics
+	InternalMetrics *InternalMetrics `yaml:"internal_metrics,omitempty"`
+}
+
+// InternalMetrics is the endpoint the canary pushes its own metrics to, for replicas that are not scraped
+type InternalMetrics struct {
+	// Endpoint takes the metrics ingest protocols: grpc (OTLP, default), http/protobuf, http/json or remote_write
+	Endpoint `yaml:",inline"`
+	Interval time.Duration `yaml:"interval,omitempty"` // time between pushes, default 30s
+	Timeout  time.Duration `yaml:"timeout,omitempty"`  // time before giving up on a push, default 10s
+}
+
+// Load reads and decodes the configuration file at path and applies defaults, it does not validate
+func Load(path string) (*CanariesConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	var cfg CanariesConfig
+	if err := yaml.NewDecoder(file).Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config file %s: %w", path, err)
+	}
+	cfg.ApplyDefaults()
+	return &cfg, nil
+}
+
+// ApplyDefaults fills in every canary setting that is not set
+func (c *CanariesConfig) ApplyDefaults() {
+	for name, canary := range c.Canaries {
+		canary.applyDefaults()
+		c.Canaries[name] = canary
+	}
+	if m := c.InternalMetrics; m != nil {
+		if m.Protocol == "" {
+			m.Protocol = ProtocolGRPC
+		}
+		if m.Interval == 0 {
+			m.Interval = 30 * time.Second
+		}
+		if m.Timeout == 0 {
+			m.Timeout = 10 * time.Second
+		}
+	}
+}
+
+// float64Ptr returns a pointer to v, the default of settings for which 0 is a value of its own
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func (c *CanaryConfig) applyDefaults() {
+	if c.MaxActiveSeries == 0 {
+		c.MaxActiveSeries = 50
+	}
+	if c.Interval == 0 {
+		c.Interval = 5 * time.Second
+	}
+	if c.WriteInterval == 0 {
+		c.WriteInterval = c.Interval
+	}
+	if c.QueryInterval == 0 {
+		c.QueryInterval = c.Interval
+	}
+	if c.QuerySampleRatio == 0 {
+		c.QuerySampleRatio = 1
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = 10 * time.Second
+	}
+	if c.QueryTimeout == 0 {
+		c.QueryTimeout = 60 * time.Second
+	}
+	if c.ScheduleJitter == nil {
+		c.ScheduleJitter = float64Ptr(0.2)
+	}
+	if c.MaxConcurrentChecks == 0 {
+		c.MaxConcurrentChecks = c.MaxActiveSeries
+	}
+	if c.TimestampTolerance == 0 {
+		c.TimestampTolerance = 5 * time.Second
+	}
+	if c.QueryInitialDelay == 0 {
+		c.QueryInitialDelay = 100 * time.Millisecond
+	}
+	if c.QueryPollInterval == 0 {
+		c.QueryPollInterval = 250 * time.Millisecond
+	}
+	if c.QueryPollBackoff == 0 {
+		c.QueryPollBackoff = 1.5
+	}
+	if c.QueryPollMaxInterval == 0 {
+		c.QueryPollMaxInterval = 5 * time.Second
+	}
+	if c.Type == "" {
+		c.Type = TypeMetrics
+	}
+	c.WriteRetry.applyDefaults()
+	c.QueryRetry.applyDefaults()
+	for i := range c.Ingest {
+		if c.Ingest[i].Protocol == "" {
+			c.Ingest[i].Protocol = ProtocolGRPC
+		}
+		c.Ingest[i].Auth = c.Auth.merge(c.Ingest[i].Auth)
+	}
+	for i := range c.Query {
+		c.Query[i].Auth = c.Auth.merge(c.Query[i].Auth)
+		if c.Query[i].Protocol == "" {
+			switch c.Type {
+			case TypeLogs:
+				c.Query[i].Protocol = ProtocolLoki
+			case TypeTraces:
+				c.Query[i].Protocol = ProtocolTempo
+			default:
+				c.Query[i].Protocol = ProtocolPrometheus
+			}
+		}
+	}
+}
+
+// merge returns the endpoint auth with defaults filled in from a, endpoint credentials replace the default credentials
+// and endpoint headers override default headers of the same name
+func (a Auth) merge(endpoint Auth) Auth {
+	merged := endpoint
+	if endpoint.BasicAuth == nil && endpoint.BearerToken == "" && endpoint.BearerTokenFile == "" && endpoint.OAuth2 == nil && endpoint.SigV4 == nil {
+		merged.BasicAuth = a.BasicAuth
+		merged.BearerToken = a.BearerToken
+		merged.BearerTokenFile = a.BearerTokenFile
+		merged.OAuth2 = a.OAuth2
+		merged.SigV4 = a.SigV4
+	}
+	if len(a.Headers) > 0 {
+		merged.Headers = make(map[string]string, len(a.Headers)+len(endpoint.Headers))
+		for name, value := range a.Headers {
+			merged.Headers[name] = value
+		}
+		for name, value := range endpoint.Headers {
+			merged.Headers[name] = value
+		}
+	}
+	return merged
 }
@@ -2,7 +2,10 @@ package config_test
 
 import (
 	"o11y-canary/internal/config"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -113,3 +116,306 @@ canary:
 		t.Errorf("Expected ingest[1] to have its own TLS config, got %+v", c1.Ingest[1].TLS)
 	}
 }
+
+func TestValidate(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(caFile, []byte("ca"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := func() config.CanaryConfig {
+		return config.CanaryConfig{
+			Ingest: []config.Endpoint{{URL: "otel-collector:4317"}, {URL: "https://vm:8428/api/v1/write", Protocol: config.ProtocolRemoteWrite}},
+			Query:  []config.Endpoint{{URL: "https://vm:8428", TLS: &config.TLSConfig{Enabled: true, CAFile: caFile}}},
+			AdditionalLabels: map[string]string{
+				"environment": "staging",
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		modify   func(c *config.CanaryConfig)
+		problems []string
+	}{
+		{"valid", func(c *config.CanaryConfig) {}, nil},
+		{"no endpoints", func(c *config.CanaryConfig) { c.Ingest, c.Query = nil, nil }, []string{
+			"at least one ingest endpoint is required", "at least one query endpoint is required",
+		}},
+		{"bad urls", func(c *config.CanaryConfig) {
+			c.Ingest[0].URL = "otel-collector"
+			c.Ingest[1].URL = "vm:8428/api/v1/write"
+			c.Query[0].URL = ""
+		}, []string{
+			`ingest[0]: url "otel-collector" is not a host:port gRPC target`,
+			`ingest[1]: url "vm:8428/api/v1/write" must use http or https`,
+			"query[0]: url is required",
+		}},
+		{"unsupported protocol", func(c *config.CanaryConfig) { c.Query[0].Protocol = config.ProtocolLoki }, []string{
+			`query[0]: protocol "loki" is not supported for metrics canaries`,
+		}},
+		{"missing tls files", func(c *config.CanaryConfig) {
+			c.TLS = &config.TLSConfig{Enabled: true, CAFile: "/does/not/exist", CertFile: "/does/not/exist"}
+		}, []string{
+			"tls: ca_file: stat /does/not/exist", "tls: cert_file and key_file must be set together",
+		}},
+		{"tls versions and ciphers", func(c *config.CanaryConfig) {
+			c.TLS = &config.TLSConfig{Enabled: true, MinVersion: "TLS1.3", CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NULL"}}
+		}, []string{
+			`tls: min_version "TLS1.3" is not supported, use TLS10, TLS11, TLS12 or TLS13`,
+			`tls: cipher_suites: unknown cipher suite "TLS_NULL"`,
+		}},
+		{"durations", func(c *config.CanaryConfig) {
+			c.QueryTimeout = c.Interval
+			c.QueryPollBackoff = 0.5
+		}, []string{
+			"query_timeout (5s) must be greater than write_interval (5s)", "query_poll_backoff must be at least 1",
+		}},
+		{"schedules", func(c *config.CanaryConfig) {
+			c.WriteInterval = 10 * time.Second
+			c.QueryInterval = 5 * time.Second
+			c.QuerySampleRatio = 1.5
+		}, []string{
+			"query_interval (5s) must not be less than write_interval (10s)",
+			"query_sample_ratio must be greater than 0 and at most 1, got 1.5",
+		}},
+		{"retry", func(c *config.CanaryConfig) {
+			invalidJitter := 2.0
+			c.WriteRetry = &config.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: time.Millisecond, BackoffMultiplier: 2, RetryableStatusCodes: []int{503, 200}}
+			c.QueryRetry = &config.RetryPolicy{InitialBackoff: time.Second, MaxBackoff: time.Second, BackoffMultiplier: 0.5, Jitter: &invalidJitter}
+		}, []string{
+			"write_retry: max_backoff (1ms) must not be less than initial_backoff (1s)",
+			"write_retry: retryable_status_codes: 200 is not an HTTP error status",
+			"query_retry: max_attempts must be at least 1, got 0",
+			"query_retry: backoff_multiplier must be at least 1, got 0.5",
+			"query_retry: jitter must be between 0 and 1, got 2",
+		}},
+		{"label name", func(c *config.CanaryConfig) { c.AdditionalLabels["bad-name"] = "x" }, []string{
+			`additional_labels: invalid label name "bad-name"`,
+		}},
+		{"auth", func(c *config.CanaryConfig) {
+			c.Ingest[0].BasicAuth = &config.BasicAuth{Password: "secret", PasswordFile: caFile}
+			c.Ingest[1].BearerToken = "token"
+			c.Ingest[1].BearerTokenFile = "/does/not/exist"
+			c.Query[0].Headers = map[string]string{"X Scope": "1"}
+		}, []string{
+			"ingest[0]: basic_auth: username is required",
+			"ingest[0]: basic_auth: password and password_file are mutually exclusive",
+			"ingest[1]: bearer_token and bearer_token_file are mutually exclusive",
+			"ingest[1]: bearer_token_file: stat /does/not/exist",
+			`query[0]: headers: invalid header name "X Scope"`,
+		}},
+		{"oauth2", func(c *config.CanaryConfig) {
+			c.Ingest[0].OAuth2 = &config.OAuth2{ClientSecret: "secret", ClientSecretFile: caFile}
+			c.Query[0].BearerToken = "token"
+			c.Query[0].OAuth2 = &config.OAuth2{ClientID: "canary", TokenURL: "idp/token"}
+		}, []string{
+			"ingest[0]: oauth2: client_id is required",
+			"ingest[0]: oauth2: client_secret and client_secret_file are mutually exclusive",
+			"ingest[0]: oauth2: token_url is required",
+			"query[0]: oauth2 is mutually exclusive with basic_auth and bearer_token",
+			`query[0]: oauth2: token_url: url "idp/token" must use http or https`,
+		}},
+		{"sigv4", func(c *config.CanaryConfig) {
+			c.Ingest[0].SigV4 = &config.SigV4{Region: "eu-west-1"}
+			c.Ingest[1].SigV4 = &config.SigV4{AccessKey: "AKID", Profile: "canary", RoleARN: "canary-role"}
+			c.Query[0].BearerToken = "token"
+			c.Query[0].SigV4 = &config.SigV4{Region: "eu-west-1"}
+		}, []string{
+			"ingest[0]: sigv4 is not supported for grpc endpoints, use http/protobuf",
+			"ingest[1]: sigv4: region is required",
+			"ingest[1]: sigv4: access_key and secret_key must be set together",
+			"ingest[1]: sigv4: access_key and profile are mutually exclusive",
+			`ingest[1]: sigv4: role_arn "canary-role" is not an ARN`,
+			"query[0]: sigv4 is mutually exclusive with basic_auth, bearer_token and oauth2",
+		}},
+		{"tenants", func(c *config.CanaryConfig) {
+			c.Tenants = []config.Tenant{{Name: "a", OrgID: "a"}, {Name: "a", AccountID: "x"}, {ProjectID: "1"}}
+			c.TenantIsolationCheck = true
+		}, []string{
+			`tenants[1]: duplicate tenant name "a"`,
+			"tenants[1]: account_id needs {tenant} in the endpoint URLs",
+			`tenants[1]: account_id "x" must be a number`,
+			"tenants[2]: name is required",
+			"tenants[2]: org_id or account_id is required",
+			"tenants[2]: project_id needs account_id",
+		}},
+		{"tenant placeholder without tenants", func(c *config.CanaryConfig) {
+			c.Ingest[1].URL = "https://vminsert:8480/insert/{tenant}/prometheus/api/v1/write"
+			c.TenantIsolationCheck = true
+		}, []string{
+			"endpoint URLs contain {tenant} but no tenants are configured",
+			"tenant_isolation_check needs at least two tenants",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.CanariesConfig{Canaries: map[string]config.CanaryConfig{"test": valid()}}
+			cfg.ApplyDefaults()
+			c := cfg.Canaries["test"]
+			tt.modify(&c)
+			cfg.Canaries["test"] = c
+			err := cfg.Validate()
+			if len(tt.problems) == 0 {
+				if err != nil {
+					t.Errorf("Expected valid config, got %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Expected problems %v, got none", tt.problems)
+			}
+			for _, problem := range tt.problems {
+				if !strings.Contains(err.Error(), `canary "test": `+problem) {
+					t.Errorf("Expected problem %q in:\n%v", problem, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if _, err := config.Load(filepath.Join(t.TempDir(), "missing.yaml")); err == nil || !strings.Contains(err.Error(), "failed to open config file") {
+		t.Errorf("Expected open error for missing file, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("canary:\n  logs:\n    type: logs\n    write_interval: 2s\n    write_retry: {}\n    query:\n      - url: http://loki:3100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	c := cfg.Canaries["logs"]
+	if c.Interval != 5*time.Second || c.Query[0].Protocol != config.ProtocolLoki {
+		t.Errorf("Expected defaults to be applied, got interval %s and query protocol %q", c.Interval, c.Query[0].Protocol)
+	}
+	if c.WriteInterval != 2*time.Second || c.QueryInterval != c.Interval || c.QuerySampleRatio != 1 {
+		t.Errorf("Expected query_interval to default to interval, got write %s, query %s, ratio %v", c.WriteInterval, c.QueryInterval, c.QuerySampleRatio)
+	}
+	if r := c.WriteRetry; r == nil || r.MaxAttempts != 3 || r.InitialBackoff != 100*time.Millisecond || len(r.RetryableStatusCodes) != 4 || c.QueryRetry != nil {
+		t.Errorf("Expected write_retry defaults and no query_retry, got %+v and %+v", c.WriteRetry, c.QueryRetry)
+	}
+}
+
+func TestInternalMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "canary:\n  vm:\n    ingest:\n      - url: otel-collector:4317\n    query:\n      - url: http://vm:8428\n" +
+		"internal_metrics:\n  url: http://vm:8428/api/v1/write\n  protocol: remote_write\n  bearer_token: token\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	m := cfg.InternalMetrics
+	if m == nil || m.Protocol != config.ProtocolRemoteWrite || m.BearerToken != "token" || m.Interval != 30*time.Second || m.Timeout != 10*time.Second {
+		t.Fatalf("Expected internal metrics endpoint with defaults, got %+v", m)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Expected valid config, got %v", err)
+	}
+
+	m.Protocol = config.ProtocolLoki
+	m.Timeout = time.Minute
+	err = cfg.Validate()
+	for _, problem := range []string{
+		`internal_metrics: protocol "loki" is not supported for metrics canaries`,
+		"internal_metrics: timeout must be positive and at most interval (30s), got 1m0s",
+	} {
+		if err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected problem %q in:\n%v", problem, err)
+		}
+	}
+}
+
+func TestScheduleJitterDefault(t *testing.T) {
+	zero := 0.0
+	cfg := config.CanariesConfig{Canaries: map[string]config.CanaryConfig{
+		"default": {Ingest: []config.Endpoint{{URL: "otel-collector:4317"}}},
+		"exact":   {Ingest: []config.Endpoint{{URL: "otel-collector:4317"}}, ScheduleJitter: &zero},
+	}}
+	cfg.ApplyDefaults()
+	if j := cfg.Canaries["default"].ScheduleJitter; j == nil || *j != 0.2 {
+		t.Errorf("Expected schedule_jitter to default to 0.2, got %v", j)
+	}
+	if j := cfg.Canaries["exact"].ScheduleJitter; j == nil || *j != 0 {
+		t.Errorf("Expected an explicit schedule_jitter of 0 to be kept, got %v", j)
+	}
+}
+
+func TestRetryJitterDefault(t *testing.T) {
+	zero := 0.0
+	cfg := config.CanariesConfig{Canaries: map[string]config.CanaryConfig{"test": {
+		Ingest:     []config.Endpoint{{URL: "otel-collector:4317"}},
+		WriteRetry: &config.RetryPolicy{},
+		QueryRetry: &config.RetryPolicy{Jitter: &zero},
+	}}}
+	cfg.ApplyDefaults()
+	c := cfg.Canaries["test"]
+	if j := c.WriteRetry.Jitter; j == nil || *j != 0.2 {
+		t.Errorf("Expected retry jitter to default to 0.2, got %v", j)
+	}
+	if j := c.QueryRetry.Jitter; j == nil || *j != 0 {
+		t.Errorf("Expected an explicit retry jitter of 0 to be kept, got %v", j)
+	}
+}
+
+func TestAuthDefaults(t *testing.T) {
+	cfg := config.CanariesConfig{Canaries: map[string]config.CanaryConfig{"test": {
+		Auth: config.Auth{
+			BasicAuth: &config.BasicAuth{Username: "canary", Password: "secret"},
+			Headers:   map[string]string{"X-Scope-OrgID": "default", "X-Team": "o11y"},
+		},
+		Ingest: []config.Endpoint{{URL: "otel-collector:4317"}},
+		Query: []config.Endpoint{{
+			URL:  "https://vm:8428",
+			Auth: config.Auth{BearerToken: "token", Headers: map[string]string{"X-Scope-OrgID": "query"}},
+		}},
+	}}}
+	cfg.ApplyDefaults()
+	c := cfg.Canaries["test"]
+
+	ingest := c.Ingest[0].Auth
+	if ingest.BasicAuth == nil || ingest.BasicAuth.Username != "canary" || ingest.Headers["X-Scope-OrgID"] != "default" {
+		t.Errorf("Expected ingest endpoint to inherit the canary auth, got %+v", ingest)
+	}
+
+	query := c.Query[0].Auth
+	if query.BasicAuth != nil || query.BearerToken != "token" {
+		t.Errorf("Expected query endpoint credentials to replace the canary ones, got %+v", query)
+	}
+	if query.Headers["X-Scope-OrgID"] != "query" || query.Headers["X-Team"] != "o11y" {
+		t.Errorf("Expected query endpoint headers merged over the canary ones, got %v", query.Headers)
+	}
+	if c.Headers["X-Scope-OrgID"] != "default" {
+		t.Errorf("Expected canary headers to be left untouched, got %v", c.Headers)
+	}
+}
+
+func TestTenantEndpoint(t *testing.T) {
+	endpoint := config.Endpoint{
+		URL:  "https://vmselect:8481/select/{tenant}/prometheus",
+		Auth: config.Auth{Headers: map[string]string{"X-Team": "o11y"}},
+	}
+
+	vm := config.Tenant{Name: "vm", AccountID: "42", ProjectID: "7"}.Endpoint(endpoint)
+	if vm.URL != "https://vmselect:8481/select/42:7/prometheus" {
+		t.Errorf("Expected account and project in the URL, got %s", vm.URL)
+	}
+
+	mimir := config.Tenant{Name: "mimir", OrgID: "team-a"}.Endpoint(endpoint)
+	if mimir.Headers[config.OrgIDHeader] != "team-a" || mimir.Headers["X-Team"] != "o11y" {
+		t.Errorf("Expected org ID added to the endpoint headers, got %v", mimir.Headers)
+	}
+	if _, ok := endpoint.Headers[config.OrgIDHeader]; ok {
+		t.Errorf("Expected the configured endpoint headers to be left untouched, got %v", endpoint.Headers)
+	}
+
+	if none := (config.Tenant{}).Endpoint(endpoint); none.URL != endpoint.URL || len(none.Headers) != 1 {
+		t.Errorf("Expected the unnamed tenant to leave the endpoint untouched, got %+v", none)
+	}
+}
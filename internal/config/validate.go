@@ -0,0 +1,405 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// labelNameRE is the Prometheus label name syntax, additional labels end up as labels on every backend
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// headerNameRE is the HTTP token syntax, gRPC metadata keys are the lower-cased header names
+var headerNameRE = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9a-zA-Z-]+$")
+
+// ingest and query protocols supported by the built-in canary types, other types are not checked
+var (
+	ingestProtocols = map[string][]string{
+		TypeMetrics: {ProtocolGRPC, ProtocolHTTPProtobuf, ProtocolHTTPJSON, ProtocolRemoteWrite},
+		TypeLogs:    {ProtocolGRPC, ProtocolHTTPProtobuf, ProtocolHTTPJSON, ProtocolLoki},
+		TypeTraces:  {ProtocolGRPC, ProtocolHTTPProtobuf, ProtocolHTTPJSON},
+	}
+	queryProtocols = map[string][]string{
+		TypeMetrics: {ProtocolPrometheus},
+		TypeLogs:    {ProtocolLoki, ProtocolLogsQL},
+		TypeTraces:  {ProtocolTempo, ProtocolJaeger, ProtocolTraceQL},
+	}
+)
+
+// Validate checks the configuration after defaults are applied and returns every problem found joined in one error
+// Each problem names the canary and field it was found in
+func (c *CanariesConfig) Validate() error {
+	if len(c.Canaries) == 0 {
+		return errors.New("no canaries configured")
+	}
+
+	names := make([]string, 0, len(c.Canaries))
+	for name := range c.Canaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		canary := c.Canaries[name]
+		for _, err := range canary.validate() {
+			errs = append(errs, fmt.Errorf("canary %q: %w", name, err))
+		}
+	}
+	for _, err := range c.InternalMetrics.validate() {
+		errs = append(errs, fmt.Errorf("internal_metrics: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (m *InternalMetrics) validate() []error {
+	if m == nil {
+		return nil
+	}
+	errs := m.Endpoint.validate(TypeMetrics, ingestProtocols)
+	if m.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval must be positive, got %s", m.Interval))
+	}
+	if m.Timeout <= 0 || m.Timeout > m.Interval {
+		errs = append(errs, fmt.Errorf("timeout must be positive and at most interval (%s), got %s", m.Interval, m.Timeout))
+	}
+	return errs
+}
+
+func (c *CanaryConfig) validate() []error {
+	var errs []error
+	problem := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if len(c.Ingest) == 0 {
+		problem("at least one ingest endpoint is required")
+	}
+	if len(c.Query) == 0 {
+		problem("at least one query endpoint is required")
+	}
+	for i, endpoint := range c.Ingest {
+		for _, err := range endpoint.validate(c.Type, ingestProtocols) {
+			problem("ingest[%d]: %w", i, err)
+		}
+	}
+	for i, endpoint := range c.Query {
+		for _, err := range endpoint.validate(c.Type, queryProtocols) {
+			problem("query[%d]: %w", i, err)
+		}
+	}
+	for _, err := range c.TLS.validate() {
+		problem("tls: %w", err)
+	}
+
+	errs = append(errs, c.validateTenants()...)
+
+	for _, err := range c.WriteRetry.validate() {
+		problem("write_retry: %w", err)
+	}
+	for _, err := range c.QueryRetry.validate() {
+		problem("query_retry: %w", err)
+	}
+
+	for name := range c.AdditionalLabels {
+		if !labelNameRE.MatchString(name) {
+			problem("additional_labels: invalid label name %q", name)
+		}
+	}
+
+	if c.Interval <= 0 {
+		problem("interval must be positive, got %s", c.Interval)
+	}
+	if c.WriteTimeout <= 0 {
+		problem("write_timeout must be positive, got %s", c.WriteTimeout)
+	}
+	if c.WriteInterval <= 0 {
+		problem("write_interval must be positive, got %s", c.WriteInterval)
+	}
+	if c.QueryInterval < c.WriteInterval {
+		problem("query_interval (%s) must not be less than write_interval (%s), data is only queried after a write", c.QueryInterval, c.WriteInterval)
+	}
+	if c.QuerySampleRatio <= 0 || c.QuerySampleRatio > 1 {
+		problem("query_sample_ratio must be greater than 0 and at most 1, got %v", c.QuerySampleRatio)
+	}
+	if c.QueryTimeout <= c.WriteInterval {
+		problem("query_timeout (%s) must be greater than write_interval (%s)", c.QueryTimeout, c.WriteInterval)
+	}
+	if c.MaxActiveSeries < 1 {
+		problem("max_active_canaried_series must be at least 1, got %d", c.MaxActiveSeries)
+	}
+	if c.MaxConcurrentChecks < 1 {
+		problem("max_concurrent_checks must be at least 1, got %d", c.MaxConcurrentChecks)
+	}
+	if j := c.ScheduleJitter; j != nil && (*j < 0 || *j > 1) {
+		problem("schedule_jitter must be between 0 and 1, got %v", *j)
+	}
+	if c.ValueTolerance < 0 {
+		problem("value_tolerance must not be negative, got %v", c.ValueTolerance)
+	}
+	if c.TimestampTolerance < 0 {
+		problem("timestamp_tolerance must not be negative, got %s", c.TimestampTolerance)
+	}
+	if c.QueryInitialDelay < 0 {
+		problem("query_initial_delay must not be negative, got %s", c.QueryInitialDelay)
+	}
+	if c.QueryInitialDelay >= c.QueryTimeout {
+		problem("query_initial_delay (%s) must be less than query_timeout (%s)", c.QueryInitialDelay, c.QueryTimeout)
+	}
+	if c.QueryPollInterval <= 0 {
+		problem("query_poll_interval must be positive, got %s", c.QueryPollInterval)
+	}
+	if c.QueryPollBackoff < 1 {
+		problem("query_poll_backoff must be at least 1, got %v", c.QueryPollBackoff)
+	}
+	if c.QueryPollMaxInterval < c.QueryPollInterval {
+		problem("query_poll_max_interval (%s) must not be less than query_poll_interval (%s)", c.QueryPollMaxInterval, c.QueryPollInterval)
+	}
+	return errs
+}
+
+// validateTenants checks tenant names are unique and that every tenant can actually be told apart by the backend
+func (c *CanaryConfig) validateTenants() []error {
+	var errs []error
+	placeholder := false
+	for _, endpoint := range append(slices.Clone(c.Ingest), c.Query...) {
+		placeholder = placeholder || strings.Contains(endpoint.URL, TenantPlaceholder)
+	}
+
+	seen := map[string]bool{}
+	for i, tenant := range c.Tenants {
+		if tenant.Name == "" {
+			errs = append(errs, fmt.Errorf("tenants[%d]: name is required", i))
+		} else if seen[tenant.Name] {
+			errs = append(errs, fmt.Errorf("tenants[%d]: duplicate tenant name %q", i, tenant.Name))
+		}
+		seen[tenant.Name] = true
+		if tenant.OrgID == "" && tenant.AccountID == "" {
+			errs = append(errs, fmt.Errorf("tenants[%d]: org_id or account_id is required", i))
+		}
+		if tenant.AccountID != "" && !placeholder {
+			errs = append(errs, fmt.Errorf("tenants[%d]: account_id needs %s in the endpoint URLs", i, TenantPlaceholder))
+		}
+		if tenant.ProjectID != "" && tenant.AccountID == "" {
+			errs = append(errs, fmt.Errorf("tenants[%d]: project_id needs account_id", i))
+		}
+		for _, id := range []struct{ field, value string }{{"account_id", tenant.AccountID}, {"project_id", tenant.ProjectID}} {
+			if _, err := strconv.ParseUint(id.value, 10, 32); id.value != "" && err != nil {
+				errs = append(errs, fmt.Errorf("tenants[%d]: %s %q must be a number", i, id.field, id.value))
+			}
+		}
+	}
+	if placeholder && len(c.Tenants) == 0 {
+		errs = append(errs, fmt.Errorf("endpoint URLs contain %s but no tenants are configured", TenantPlaceholder))
+	}
+	if c.TenantIsolationCheck && len(c.Tenants) < 2 {
+		errs = append(errs, errors.New("tenant_isolation_check needs at least two tenants"))
+	}
+	return errs
+}
+
+func (e *Endpoint) validate(canaryType string, protocols map[string][]string) []error {
+	var errs []error
+	if supported, ok := protocols[canaryType]; ok && !slices.Contains(supported, e.Protocol) {
+		errs = append(errs, fmt.Errorf("protocol %q is not supported for %s canaries, use one of %s", e.Protocol, canaryType, strings.Join(supported, ", ")))
+	}
+	// placeholders are checked against the tenants, the URL has to parse once one is filled in
+	if err := validateURL(strings.ReplaceAll(e.URL, TenantPlaceholder, "0"), e.Protocol); err != nil {
+		errs = append(errs, err)
+	}
+	switch e.Compression {
+	case "", CompressionNone, CompressionGzip:
+	default:
+		errs = append(errs, fmt.Errorf("compression %q is not supported, use %s or %s", e.Compression, CompressionNone, CompressionGzip))
+	}
+	for _, err := range e.TLS.validate() {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	if e.SigV4 != nil && e.Protocol == ProtocolGRPC {
+		errs = append(errs, errors.New("sigv4 is not supported for grpc endpoints, use http/protobuf"))
+	}
+	errs = append(errs, e.Auth.validate()...)
+	return errs
+}
+
+// validateURL checks gRPC targets are host:port (or a resolver URL) and everything else is an http(s) URL
+func validateURL(raw string, protocol string) error {
+	if raw == "" {
+		return errors.New("url is required")
+	}
+	if protocol == ProtocolGRPC && !strings.Contains(raw, "://") {
+		if _, _, err := net.SplitHostPort(raw); err != nil {
+			return fmt.Errorf("url %q is not a host:port gRPC target: %w", raw, err)
+		}
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("url %q is invalid: %w", raw, err)
+	}
+	if protocol != ProtocolGRPC && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url %q must use http or https", raw)
+	}
+	if u.Host == "" && protocol != ProtocolGRPC {
+		return fmt.Errorf("url %q has no host", raw)
+	}
+	return nil
+}
+
+// validate checks the merged auth of an endpoint, so problems in canary defaults are reported on each endpoint
+func (a *Auth) validate() []error {
+	var errs []error
+	if a.BasicAuth != nil {
+		if a.BasicAuth.Username == "" {
+			errs = append(errs, errors.New("basic_auth: username is required"))
+		}
+		if a.BasicAuth.Password != "" && a.BasicAuth.PasswordFile != "" {
+			errs = append(errs, errors.New("basic_auth: password and password_file are mutually exclusive"))
+		}
+		if a.BearerToken != "" || a.BearerTokenFile != "" {
+			errs = append(errs, errors.New("basic_auth and bearer_token are mutually exclusive"))
+		}
+		if err := fileExists(a.BasicAuth.PasswordFile); err != nil {
+			errs = append(errs, fmt.Errorf("basic_auth: password_file: %w", err))
+		}
+	}
+	if a.BearerToken != "" && a.BearerTokenFile != "" {
+		errs = append(errs, errors.New("bearer_token and bearer_token_file are mutually exclusive"))
+	}
+	if a.OAuth2 != nil {
+		if a.BasicAuth != nil || a.BearerToken != "" || a.BearerTokenFile != "" {
+			errs = append(errs, errors.New("oauth2 is mutually exclusive with basic_auth and bearer_token"))
+		}
+		for _, err := range a.OAuth2.validate() {
+			errs = append(errs, fmt.Errorf("oauth2: %w", err))
+		}
+	}
+	if a.SigV4 != nil {
+		if a.BasicAuth != nil || a.BearerToken != "" || a.BearerTokenFile != "" || a.OAuth2 != nil {
+			errs = append(errs, errors.New("sigv4 is mutually exclusive with basic_auth, bearer_token and oauth2"))
+		}
+		for _, err := range a.SigV4.validate() {
+			errs = append(errs, fmt.Errorf("sigv4: %w", err))
+		}
+	}
+	if err := fileExists(a.BearerTokenFile); err != nil {
+		errs = append(errs, fmt.Errorf("bearer_token_file: %w", err))
+	}
+	names := make([]string, 0, len(a.Headers))
+	for name := range a.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !headerNameRE.MatchString(name) {
+			errs = append(errs, fmt.Errorf("headers: invalid header name %q", name))
+		}
+	}
+	return errs
+}
+
+func (o *OAuth2) validate() []error {
+	var errs []error
+	if o.ClientID == "" {
+		errs = append(errs, errors.New("client_id is required"))
+	}
+	if o.ClientSecret != "" && o.ClientSecretFile != "" {
+		errs = append(errs, errors.New("client_secret and client_secret_file are mutually exclusive"))
+	}
+	if err := fileExists(o.ClientSecretFile); err != nil {
+		errs = append(errs, fmt.Errorf("client_secret_file: %w", err))
+	}
+	if o.TokenURL == "" {
+		errs = append(errs, errors.New("token_url is required"))
+	} else if err := validateURL(o.TokenURL, ""); err != nil {
+		errs = append(errs, fmt.Errorf("token_url: %w", err))
+	}
+	return errs
+}
+
+func (s *SigV4) validate() []error {
+	var errs []error
+	if s.Region == "" {
+		errs = append(errs, errors.New("region is required"))
+	}
+	if (s.AccessKey == "") != (s.SecretKey == "") {
+		errs = append(errs, errors.New("access_key and secret_key must be set together"))
+	}
+	if s.AccessKey != "" && s.Profile != "" {
+		errs = append(errs, errors.New("access_key and profile are mutually exclusive"))
+	}
+	if s.RoleARN != "" && !strings.HasPrefix(s.RoleARN, "arn:") {
+		errs = append(errs, fmt.Errorf("role_arn %q is not an ARN", s.RoleARN))
+	}
+	return errs
+}
+
+// fileExists reports an error unless path is empty or can be stat'ed
+func fileExists(path string) error {
+	if path == "" {
+		return nil
+	}
+	_, err := os.Stat(path)
+	return err
+}
+
+func (t *TLSConfig) validate() []error {
+	if t == nil || !t.Enabled {
+		return nil
+	}
+	var errs []error
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		errs = append(errs, errors.New("cert_file and key_file must be set together"))
+	}
+	for field, path := range map[string]string{"ca_file": t.CAFile, "cert_file": t.CertFile, "key_file": t.KeyFile} {
+		if err := fileExists(path); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	if _, ok := TLSVersions[t.MinVersion]; t.MinVersion != "" && !ok {
+		errs = append(errs, fmt.Errorf("min_version %q is not supported, use TLS10, TLS11, TLS12 or TLS13", t.MinVersion))
+	}
+	for _, name := range t.CipherSuites {
+		if _, ok := CipherSuite(name); !ok {
+			errs = append(errs, fmt.Errorf("cipher_suites: unknown cipher suite %q", name))
+		}
+	}
+	return errs
+}
+
+// validate checks the retry policy, a nil policy never retries
+func (r *RetryPolicy) validate() []error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	if r.MaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("max_attempts must be at least 1, got %d", r.MaxAttempts))
+	}
+	if r.InitialBackoff <= 0 {
+		errs = append(errs, fmt.Errorf("initial_backoff must be positive, got %s", r.InitialBackoff))
+	}
+	if r.MaxBackoff < r.InitialBackoff {
+		errs = append(errs, fmt.Errorf("max_backoff (%s) must not be less than initial_backoff (%s)", r.MaxBackoff, r.InitialBackoff))
+	}
+	if r.BackoffMultiplier < 1 {
+		errs = append(errs, fmt.Errorf("backoff_multiplier must be at least 1, got %v", r.BackoffMultiplier))
+	}
+	if j := r.Jitter; j != nil && (*j < 0 || *j > 1) {
+		errs = append(errs, fmt.Errorf("jitter must be between 0 and 1, got %v", *j))
+	}
+	for _, code := range r.RetryableStatusCodes {
+		if code < 400 || code > 599 {
+			errs = append(errs, fmt.Errorf("retryable_status_codes: %d is not an HTTP error status", code))
+		}
+	}
+	return errs
+}
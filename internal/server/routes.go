@@ -1 +1,62 @@
 package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// routes registers the metrics, profiling, health and status handlers
+func (s *Server) routes() {
+	// pprof boilerplate
+	s.Router.HandleFunc("/debug/pprof/", pprof.Index)
+	s.Router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.Router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.Router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.Router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.Router.HandleFunc("/debug/pprof/allocs", pprof.Handler("allocs").ServeHTTP)
+	s.Router.HandleFunc("/debug/pprof/goroutine", pprof.Handler("goroutine").ServeHTTP)
+
+	s.Router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	s.Router.HandleFunc("/-/healthy", s.healthy).Methods("GET", "HEAD")
+	s.Router.HandleFunc("/-/ready", s.ready).Methods("GET", "HEAD")
+	s.Router.HandleFunc("/api/v1/status", s.status).Methods("GET")
+}
+
+// healthy reports the process is up and serving
+func (s *Server) healthy(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "o11y-canary is healthy.")
+}
+
+// ready reports 200 once every canary has checked every path and 503 before, naming the pending and failed canaries
+func (s *Server) ready(w http.ResponseWriter, _ *http.Request) {
+	if ok, pending, failed := s.Status.Ready(); !ok {
+		var reasons []string
+		if len(pending) > 0 {
+			reasons = append(reasons, "waiting for canaries: "+strings.Join(pending, ", "))
+		}
+		if len(failed) > 0 {
+			reasons = append(reasons, "failed to start: "+strings.Join(failed, ", "))
+		}
+		http.Error(w, "o11y-canary is not ready, "+strings.Join(reasons, "; "), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "o11y-canary is ready.")
+}
+
+// status serves the state of every canary as JSON
+func (s *Server) status(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	body := struct {
+		Canaries []CanaryStatus `json:"canaries"`
+	}{Canaries: s.Status.Canaries()}
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		slog.Error("Failed to encode status", "error", err)
+	}
+}
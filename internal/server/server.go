@@ -1,9 +1,46 @@
 package server
 
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
 // Server is configuration for metrics server and status endpoint
 type Server struct {
+	// Addr is the listen address, e.g. :8080
+	Addr string
+	// Router serves metrics, profiling, health and status, more handlers can be added before ListenAndServe
+	Router *mux.Router
+	// Status holds the canary state behind /-/ready and /api/v1/status
+	Status *Status
+}
+
+// New creates new server listening on addr with the metrics, profiling, health and status handlers registered
+func New(addr string, status *Status) *Server {
+	s := &Server{Addr: addr, Router: mux.NewRouter(), Status: status}
+	s.routes()
+	return s
 }
 
-// New creates new server
-func (s *Server) New() {
+// ListenAndServe serves until ctx is cancelled, then shuts the server down gracefully
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	srv := &http.Server{Addr: s.Addr, Handler: s.Router}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Error("Failed to shut down http server", "error", err)
+		}
+	}()
+	slog.Info("Starting metrics & profiling http server", "address", s.Addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(t *testing.T, s *Server, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec
+}
+
+func TestReady(t *testing.T) {
+	status := NewStatus()
+	s := New(":0", status)
+	status.SetCanaries([]string{"a", "b"})
+	status.Start("a", "metrics", []string{""}, []string{"collector:4317"}, []string{"http://prom:9090"})
+	status.Start("b", "logs", []string{""}, []string{"collector:4317"}, []string{"http://loki:3100"})
+
+	if rec := get(t, s, "/-/healthy"); rec.Code != http.StatusOK {
+		t.Errorf("Expected healthy to return 200, got %d", rec.Code)
+	}
+	rec := get(t, s, "/-/ready")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "a, b") {
+		t.Errorf("Expected 503 naming both canaries before any check, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	status.RecordWrite("a", "", "collector:4317", nil)
+	status.RecordQuery("a", "", "collector:4317", "http://prom:9090", time.Second, nil)
+	// writes alone do not make a canary ready, e.g. when the query sample ratio skipped its first queries
+	status.RecordWrite("b", "", "collector:4317", nil)
+	rec = get(t, s, "/-/ready")
+	if rec.Code != http.StatusServiceUnavailable || !strings.HasSuffix(rec.Body.String(), "canaries: b\n") {
+		t.Errorf("Expected 503 naming only the canary that has not queried yet, got %d %q", rec.Code, rec.Body.String())
+	}
+	// a failed check still completes the cycle, the failure is reported by the status and metrics
+	status.RecordQuery("b", "", "collector:4317", "http://loki:3100", 0, errors.New("query failed"))
+	if rec := get(t, s, "/-/ready"); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 once every canary completed a check, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	// a canary added on reload has to complete its own check
+	status.SetCanaries([]string{"a", "c"})
+	rec = get(t, s, "/-/ready")
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "c") || strings.Contains(rec.Body.String(), "b") {
+		t.Errorf("Expected 503 naming only the added canary, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestReadyEveryPath(t *testing.T) {
+	status := NewStatus()
+	s := New(":0", status)
+	status.SetCanaries([]string{"a", "broken"})
+	status.Start("a", "metrics", []string{""}, []string{"collector-1:4317", "collector-2:4317"}, []string{"http://prom:9090", "http://thanos:9090"})
+
+	status.RecordWrite("a", "", "collector-1:4317", nil)
+	status.RecordWrite("a", "", "collector-2:4317", nil)
+	status.RecordQuery("a", "", "collector-1:4317", "http://prom:9090", time.Second, nil)
+	status.RecordQuery("a", "", "collector-1:4317", "http://thanos:9090", time.Second, nil)
+	status.RecordQuery("a", "", "collector-2:4317", "http://prom:9090", time.Second, nil)
+	status.RecordWriteCheck("a", nil)
+	status.RecordQueryCheck("a", nil)
+	if _, pending, _ := status.Ready(); !slices.Equal(pending, []string{"a", "broken"}) {
+		t.Errorf("Expected a to wait for its last path, got %v", pending)
+	}
+	// the paths of a failed write are checked by it, there is nothing to query
+	status.RecordWrite("a", "", "collector-2:4317", errors.New("connection refused"))
+	if _, pending, _ := status.Ready(); !slices.Equal(pending, []string{"broken"}) {
+		t.Errorf("Expected a to be ready once every path was checked, got %v", pending)
+	}
+
+	// a canary that could not start is reported as failed rather than pending
+	status.RecordError("broken", errors.New("failed to initialize ingest client"))
+	rec := get(t, s, "/-/ready")
+	if rec.Code != http.StatusServiceUnavailable || !strings.HasSuffix(rec.Body.String(), "not ready, failed to start: broken\n") {
+		t.Errorf("Expected 503 naming the failed canary, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestStatus(t *testing.T) {
+	status := NewStatus()
+	s := New(":0", status)
+	status.SetCanaries([]string{"a", "broken"})
+	status.Start("a", "metrics", []string{"team-a", "team-b"}, []string{"collector-1:4317", "collector-2:4317"}, []string{"http://prom:9090"})
+	status.RecordError("broken", errors.New("failed to initialize ingest client"))
+
+	status.RecordWrite("a", "team-a", "collector-1:4317", nil)
+	status.RecordWrite("a", "team-a", "collector-2:4317", errors.New("connection refused"))
+	status.RecordQuery("a", "team-a", "collector-1:4317", "http://prom:9090", 1500*time.Millisecond, nil)
+	status.RecordWrite("a", "team-b", "collector-1:4317", nil)
+	status.RecordWrite("a", "team-b", "collector-2:4317", nil)
+	status.RecordQuery("a", "team-b", "collector-1:4317", "http://prom:9090", 0, errors.New("not visible"))
+	status.RecordQuery("a", "team-b", "collector-2:4317", "http://prom:9090", 0, errors.New("not visible"))
+	status.RecordWriteCheck("a", errors.New("write to collector-2:4317: connection refused"))
+	status.RecordQueryCheck("a", nil)
+	// records for canaries that are not configured are dropped
+	status.RecordWriteCheck("removed", nil)
+
+	rec := get(t, s, "/api/v1/status")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Expected JSON content type, got %q", ct)
+	}
+	var body struct {
+		Canaries []CanaryStatus `json:"canaries"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if len(body.Canaries) != 2 {
+		t.Fatalf("Expected 2 canaries, got %+v", body.Canaries)
+	}
+
+	a := body.Canaries[0]
+	if a.Name != "a" || !a.Ready || a.LastResult != ResultFailure || a.LastCheck == nil {
+		t.Errorf("Unexpected state for a: %+v", a)
+	}
+	if a.LastLagSeconds == nil || *a.LastLagSeconds != 1.5 {
+		t.Errorf("Expected last lag of 1.5s, got %v", a.LastLagSeconds)
+	}
+	if !a.Ingest[0].Up || a.Ingest[0].LastSuccess == nil || a.Ingest[1].Up || a.Ingest[1].LastError != "connection refused" {
+		t.Errorf("Unexpected ingest state: %+v", a.Ingest)
+	}
+	if len(a.Paths) != 4 || !a.Paths[0].Up || a.Paths[1].Up || a.Paths[1].LastSuccess != nil || a.Paths[1].LastError != "write failed: connection refused" {
+		t.Errorf("Unexpected path state: %+v", a.Paths)
+	}
+	// the same endpoints used as another tenant are tracked separately
+	if len(a.Ingest) != 4 || a.Ingest[2].Tenant != "team-b" || !a.Ingest[2].Up || a.Paths[2].Tenant != "team-b" || a.Paths[2].Up {
+		t.Errorf("Expected separate state for team-b, got %+v %+v", a.Ingest, a.Paths)
+	}
+
+	if a.LastError != "write to collector-2:4317: connection refused" {
+		t.Errorf("Expected the write error to stay after a successful query, got %q", a.LastError)
+	}
+
+	broken := body.Canaries[1]
+	if broken.Ready || !broken.Failed || broken.LastResult != ResultFailure || !strings.Contains(broken.LastError, "ingest client") {
+		t.Errorf("Unexpected state for broken: %+v", broken)
+	}
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status tracks the latest check results of every configured canary for the status and readiness endpoints
+type Status struct {
+	mu       sync.Mutex
+	canaries map[string]*CanaryStatus
+}
+
+// CanaryStatus is the state of one canary as served by /api/v1/status
+type CanaryStatus struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Ready is true once the canary has completed one check of every path since it was (re)started, i.e. both a
+	// write through every ingest endpoint and a query of every path, successful or not. The paths of a failed write
+	// count as checked, they fail with it
+	Ready bool `json:"ready"`
+	// Failed is true when the canary could not start, e.g. its clients could not be set up, LastError says why
+	// It runs no checks until a reload restarts it
+	Failed bool `json:"failed,omitempty"`
+	// LastResult is failure when the last completed write or query of a check failed, empty before the first one
+	LastResult     string     `json:"last_result"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastCheck      *time.Time `json:"last_check,omitempty"`
+	LastLagSeconds *float64   `json:"last_lag_seconds,omitempty"`
+	// Ingest holds the write state of each ingest endpoint
+	Ingest []EndpointStatus `json:"ingest"`
+	// Paths holds the query state of each ingest and query endpoint pair
+	Paths []PathStatus `json:"paths"`
+
+	// writeErr and queryErr hold the errors of the last completed writes and queries of a check
+	writeErr, queryErr string
+}
+
+// EndpointStatus is the result of the last write through an ingest endpoint
+type EndpointStatus struct {
+	Tenant      string     `json:"tenant,omitempty"`
+	URL         string     `json:"url"`
+	Up          bool       `json:"up"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+
+	// checked is set by the first write through the endpoint
+	checked bool
+}
+
+// PathStatus is the result of the last query for data written through IngestEndpoint at QueryEndpoint
+type PathStatus struct {
+	Tenant         string     `json:"tenant,omitempty"`
+	IngestEndpoint string     `json:"ingest_endpoint"`
+	QueryEndpoint  string     `json:"query_endpoint"`
+	Up             bool       `json:"up"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	LastLagSeconds *float64   `json:"last_lag_seconds,omitempty"`
+
+	// checked is set by the first query of the path, or the first failed write through its ingest endpoint
+	checked bool
+}
+
+// Result values of CanaryStatus.LastResult
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// NewStatus provides an empty Status, canaries are added with SetCanaries
+func NewStatus() *Status {
+	return &Status{canaries: map[string]*CanaryStatus{}}
+}
+
+// SetCanaries makes names the configured canaries, adding placeholders for new ones and dropping removed ones
+func (s *Status) SetCanaries(names []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+		if _, ok := s.canaries[name]; !ok {
+			s.canaries[name] = &CanaryStatus{Name: name}
+		}
+	}
+	for name := range s.canaries {
+		if !keep[name] {
+			delete(s.canaries, name)
+		}
+	}
+}
+
+// Start resets the state of a canary that is (re)starting with the given tenants, ingest and query endpoints
+// A canary without tenants has the single tenant ""
+func (s *Status) Start(name, canaryType string, tenants, ingest, query []string) {
+	cs := &CanaryStatus{
+		Name:   name,
+		Type:   canaryType,
+		Ingest: make([]EndpointStatus, 0, len(tenants)*len(ingest)),
+		Paths:  make([]PathStatus, 0, len(tenants)*len(ingest)*len(query)),
+	}
+	for _, tenant := range tenants {
+		for _, in := range ingest {
+			cs.Ingest = append(cs.Ingest, EndpointStatus{Tenant: tenant, URL: in})
+			for _, q := range query {
+				cs.Paths = append(cs.Paths, PathStatus{Tenant: tenant, IngestEndpoint: in, QueryEndpoint: q})
+			}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.canaries[name] = cs
+}
+
+// RecordError marks a canary as failed to start, e.g. when its clients cannot be set up
+func (s *Status) RecordError(name string, err error) {
+	s.update(name, func(cs *CanaryStatus) {
+		cs.Failed = true
+		cs.LastResult = ResultFailure
+		cs.LastError = err.Error()
+	})
+}
+
+// RecordWrite stores the outcome of a write through ingest as tenant
+// A failed write also fails the paths from ingest, there is nothing for them to query
+func (s *Status) RecordWrite(name, tenant, ingest string, err error) {
+	now := time.Now()
+	s.update(name, func(cs *CanaryStatus) {
+		for i := range cs.Ingest {
+			ep := &cs.Ingest[i]
+			if ep.Tenant != tenant || ep.URL != ingest {
+				continue
+			}
+			ep.checked = true
+			ep.Up = err == nil
+			if err != nil {
+				ep.LastError = err.Error()
+				continue
+			}
+			ep.LastError = ""
+			ep.LastSuccess = &now
+		}
+		if err != nil {
+			for i := range cs.Paths {
+				path := &cs.Paths[i]
+				if path.Tenant != tenant || path.IngestEndpoint != ingest {
+					continue
+				}
+				path.checked = true
+				path.Up = false
+				path.LastError = "write failed: " + err.Error()
+			}
+		}
+		cs.updateReady()
+	})
+}
+
+// RecordQuery stores the outcome of polling query for data written through ingest as tenant, lag is only used on success
+func (s *Status) RecordQuery(name, tenant, ingest, query string, lag time.Duration, err error) {
+	now := time.Now()
+	s.update(name, func(cs *CanaryStatus) {
+		for i := range cs.Paths {
+			path := &cs.Paths[i]
+			if path.Tenant != tenant || path.IngestEndpoint != ingest || path.QueryEndpoint != query {
+				continue
+			}
+			path.checked = true
+			path.Up = err == nil
+			if err != nil {
+				path.LastError = err.Error()
+				continue
+			}
+			seconds := lag.Seconds()
+			path.LastError = ""
+			path.LastSuccess = &now
+			path.LastLagSeconds = &seconds
+			cs.LastLagSeconds = &seconds
+		}
+		cs.updateReady()
+	})
+}
+
+// RecordWriteCheck completes the writes of a check through every ingest endpoint, err joins the write errors seen
+func (s *Status) RecordWriteCheck(name string, err error) {
+	s.update(name, func(cs *CanaryStatus) {
+		cs.writeErr = errorString(err)
+		cs.recordCheck()
+	})
+}
+
+// RecordQueryCheck completes the queries of a check of every path, err joins the query errors seen
+// Checks the query sample ratio skipped are not recorded
+func (s *Status) RecordQueryCheck(name string, err error) {
+	s.update(name, func(cs *CanaryStatus) {
+		cs.queryErr = errorString(err)
+		cs.recordCheck()
+	})
+}
+
+// updateReady makes the canary ready once every ingest endpoint and path has been checked
+func (cs *CanaryStatus) updateReady() {
+	for _, ep := range cs.Ingest {
+		if !ep.checked {
+			return
+		}
+	}
+	for _, path := range cs.Paths {
+		if !path.checked {
+			return
+		}
+	}
+	cs.Ready = true
+}
+
+// recordCheck updates the result from the last write and query errors
+func (cs *CanaryStatus) recordCheck() {
+	now := time.Now()
+	cs.LastCheck = &now
+	var errs []string
+	for _, err := range []string{cs.writeErr, cs.queryErr} {
+		if err != "" {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		cs.LastResult = ResultFailure
+		cs.LastError = strings.Join(errs, "\n")
+		return
+	}
+	cs.LastResult = ResultSuccess
+	cs.LastError = ""
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Canaries returns a copy of the state of every configured canary, sorted by name
+func (s *Status) Canaries() []CanaryStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]CanaryStatus, 0, len(s.canaries))
+	for _, cs := range s.canaries {
+		c := *cs
+		c.Ingest = append([]EndpointStatus{}, cs.Ingest...)
+		c.Paths = append([]PathStatus{}, cs.Paths...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Ready reports whether every configured canary has checked every path, returning the sorted names of those still
+// checking and of those that failed to start
+func (s *Status) Ready() (ok bool, pending, failed []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, cs := range s.canaries {
+		switch {
+		case cs.Failed:
+			failed = append(failed, name)
+		case !cs.Ready:
+			pending = append(pending, name)
+		}
+	}
+	sort.Strings(pending)
+	sort.Strings(failed)
+	return len(pending) == 0 && len(failed) == 0, pending, failed
+}
+
+// update applies fn to the canary's state, ignoring canaries that are no longer configured
+func (s *Status) update(name string, fn func(cs *CanaryStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cs, ok := s.canaries[name]; ok {
+		fn(cs)
+	}
+}
@@ -85,6 +85,11 @@ func InitOTLPMeterProvider(ctx context.Context, res *resource.Resource, conn *gr
 		return nil, fmt.Errorf("failed to create metrics exporter: %w", err)
 	}
 
+	return InitMeterProviderWithExporter(res, metricExporter, timeout), nil
+}
+
+// InitMeterProviderWithExporter configures the canary meter provider around an already built exporter
+func InitMeterProviderWithExporter(res *resource.Resource, metricExporter metric.Exporter, timeout time.Duration) *metric.MeterProvider {
 	// small buffer to prevent thundering herd as "The collect and export time are not counted towards the interval between attempts."
 	buffer := 5 * time.Second
 	interval := timeout + buffer
@@ -96,12 +101,10 @@ func InitOTLPMeterProvider(ctx context.Context, res *resource.Resource, conn *gr
 		metric.WithTimeout(timeout),
 	)
 
-	meterProvider := metric.NewMeterProvider(
+	return metric.NewMeterProvider(
 		metric.WithReader(reader),
 		metric.WithResource(res),
 	)
-
-	return meterProvider, nil
 }
 
 func setupTracing(ctx context.Context, res *resource.Resource, endpoint string) (*trace.TracerProvider, func(context.Context) error, error) {